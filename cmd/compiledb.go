@@ -0,0 +1,408 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagCompiledbOutput string
+)
+
+// compileCommand is an entry of a compilation database (compile_commands.json),
+// as read by clangd and other tools.
+type compileCommand struct {
+	Directory string   `json:"directory"`
+	Arguments []string `json:"arguments"`
+	File      string   `json:"file"`
+	Output    string   `json:"output,omitempty"`
+}
+
+var (
+	// compilerRegexp matches the names of C/C++ compilers, including cross
+	// compilers (eg: "mips64-elf-gcc").
+	compilerRegexp = regexp.MustCompile(`(^|-)(gcc|g\+\+|cc|c\+\+|clang|clang\+\+)(-[0-9.]+)?(\.exe)?$`)
+
+	// makeDirRegexp matches the lines printed by make -w when it changes directory.
+	makeDirRegexp = regexp.MustCompile("^\\S*make(\\[\\d+\\])?: (Entering|Leaving) directory ['`](.*)'$")
+
+	// sourceExts are the extensions of the source files recorded in the
+	// compilation database.
+	sourceExts = map[string]bool{".c": true, ".cc": true, ".cpp": true, ".cxx": true, ".c++": true, ".s": true, ".S": true}
+)
+
+// splitShellWords splits a command line, as printed by make, into words
+// following the quoting rules of the shell. Command separators (";", "&&",
+// "|", etc.) are returned as separate words.
+func splitShellWords(line string) []string {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	flush := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			flush()
+		case c == ';' || c == '&' || c == '|':
+			flush()
+			sep := string(c)
+			if i+1 < len(line) && line[i+1] == c {
+				sep += string(c)
+				i++
+			}
+			words = append(words, sep)
+		case c == '\\' && i+1 < len(line):
+			i++
+			if line[i] != '\n' {
+				word.WriteByte(line[i])
+				inWord = true
+			}
+		case c == '\'':
+			inWord = true
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				end = len(line) - i - 1
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+		case c == '"':
+			inWord = true
+			for i++; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) && strings.IndexByte("\\\"$`\n", line[i+1]) >= 0 {
+					i++
+				}
+				word.WriteByte(line[i])
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	flush()
+	return words
+}
+
+// isCommandSeparator returns true if word separates commands in a command line.
+func isCommandSeparator(word string) bool {
+	return word == ";" || word == "&" || word == "&&" || word == "|" || word == "||"
+}
+
+// parseCompileCommand returns the compilation database entry for a command,
+// or false if it is not the compilation of a source file.
+func parseCompileCommand(args []string, dir string) (compileCommand, bool) {
+	// Skip environment variable assignments
+	for len(args) > 0 && strings.Contains(args[0], "=") && !strings.HasPrefix(args[0], "-") {
+		args = args[1:]
+	}
+	if len(args) == 0 || !compilerRegexp.MatchString(path.Base(filepath.ToSlash(args[0]))) {
+		return compileCommand{}, false
+	}
+
+	cc := compileCommand{Directory: dir, Arguments: args}
+	compile := false
+	for i := 1; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-c":
+			compile = true
+		case arg == "-o" && i+1 < len(args):
+			i++
+			cc.Output = args[i]
+		case arg == "-MF" || arg == "-MT" || arg == "-MQ" || arg == "-include" || arg == "-imacros" ||
+			arg == "-I" || arg == "-isystem" || arg == "-iquote" || arg == "-idirafter" || arg == "-x":
+			// Options with a separate argument
+			i++
+		case !strings.HasPrefix(arg, "-") && sourceExts[path.Ext(arg)]:
+			cc.File = arg
+		}
+	}
+	return cc, compile && cc.File != ""
+}
+
+// parseCompileCommands extracts the compilations of source files from the
+// output of "make -n -w", that was run in the specified directory.
+func parseCompileCommands(output []byte, dir string) []compileCommand {
+	var commands []compileCommand
+	dirs := []string{dir}
+
+	var line string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		// Join continuation lines
+		line += scanner.Text()
+		if strings.HasSuffix(line, "\\") {
+			line += "\n"
+			continue
+		}
+
+		if m := makeDirRegexp.FindStringSubmatch(line); m != nil {
+			if m[2] == "Entering" {
+				dirs = append(dirs, m[3])
+			} else if len(dirs) > 1 {
+				dirs = dirs[:len(dirs)-1]
+			}
+		} else {
+			words := splitShellWords(line)
+			start := 0
+			for i := 0; i <= len(words); i++ {
+				if i == len(words) || isCommandSeparator(words[i]) {
+					if cc, ok := parseCompileCommand(words[start:i], dirs[len(dirs)-1]); ok {
+						commands = append(commands, cc)
+					}
+					start = i + 1
+				}
+			}
+		}
+		line = ""
+	}
+	return commands
+}
+
+// mapPath converts a path through the specified mappings. Paths that are not
+// within any of the mapped directories are returned as-is.
+func mapPath(p string, mappings []pathMapping) string {
+	for _, m := range mappings {
+		if p == m.container || strings.HasPrefix(p, m.container+"/") {
+			return m.host + filepath.FromSlash(p[len(m.container):])
+		}
+	}
+	return p
+}
+
+// mapArg converts the path within a compiler argument through the specified
+// mappings. The path can be prefixed by an option (eg: "-I/app/include").
+func mapArg(arg string, mappings []pathMapping) string {
+	idx := strings.IndexByte(arg, '/')
+	if idx < 0 || (idx > 0 && !strings.HasPrefix(arg, "-")) {
+		return arg
+	}
+	return arg[:idx] + mapPath(arg[idx:], mappings)
+}
+
+// toolchainIncludeDirs returns the system include directories of the toolchain
+// compiler, in search order.
+func toolchainIncludeDirs() []string {
+	out, err := captureToolchain("sh", "-c", "mips64-elf-gcc -xc -E -v - </dev/null 2>&1")
+	if err != nil {
+		fatal("error querying the include directories of the toolchain: %v\n", err)
+	}
+
+	var dirs []string
+	found := false
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#include <...> search starts here"):
+			found = true
+		case strings.HasPrefix(line, "End of search list"):
+			found = false
+		case found && line != "":
+			dirs = append(dirs, line)
+		}
+	}
+	return dirs
+}
+
+// cacheDirName returns a name for a cache directory derived from s (eg: an
+// image ID or reference), replacing the characters that cannot be used in
+// file names.
+func cacheDirName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, strings.TrimPrefix(s, "sha256:"))
+}
+
+// cacheToolchainHeaders copies the specified include directories from the
+// toolchain container to the host cache directory, so that tools running on
+// the host can read the system headers. It returns the mappings from the
+// container directories to the copies.
+func cacheToolchainHeaders(dirs []string) []pathMapping {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		fatal("cannot find the cache directory: %v\n", err)
+	}
+
+	// Headers can differ between toolchain images, so use a different
+	// cache for each of them.
+	root := findProjectRoot()
+	rt := mustFindRuntime()
+	info, err := rt.InspectContainer(searchContainer(root, true))
+	if err != nil {
+		fatal("error inspecting the toolchain container: %v\n", err)
+	}
+	image := info.Image
+	if image == "" {
+		// The image ID is not known (see containerInfo)
+		image = info.ImageRef
+	}
+	cacheDir = filepath.Join(cacheDir, "libdragon", "headers", cacheDirName(image))
+
+	progress("Copying toolchain headers to %s...\n", cacheDir)
+	var mappings []pathMapping
+	for _, dir := range dirs {
+		dir = path.Clean(dir)
+		target := filepath.Join(cacheDir, filepath.FromSlash(dir))
+
+		// Headers are copied every time, as installing libdragon modifies
+		// them too.
+		out, err := captureToolchain("tar", "-C", dir, "-chf", "-", ".")
+		if err != nil {
+			fatal("error copying the headers in %s: %v\n", dir, err)
+		}
+		tb, err := loadTarball(out, false)
+		if err == nil {
+			os.RemoveAll(target)
+			_, err = tb.extractFiles(target)
+		}
+		if err != nil {
+			fatal("error copying the headers in %s: %v\n", dir, err)
+		}
+		mappings = append(mappings, pathMapping{dir, target})
+	}
+	return mappings
+}
+
+// toolchainHeaders returns the system include directories of the toolchain, as
+// host paths. When the toolchain runs in a container, the headers are copied
+// to the host (see cacheToolchainHeaders), and the mappings from container
+// paths to the copies are returned as well.
+func toolchainHeaders() ([]string, []pathMapping) {
+	includes := toolchainIncludeDirs()
+	if findToolchain().Name() == TOOLCHAIN_NATIVE {
+		return includes, nil
+	}
+	headers := cacheToolchainHeaders(includes)
+	for i := range includes {
+		includes[i] = headers[i].host
+	}
+	return includes, headers
+}
+
+// generateCompiledb writes a compilation database for the build run by make
+// with the specified arguments. The build is not actually run: make is asked
+// to print all the commands it would run instead (with -n), and the compiler
+// invocations are extracted from them. When the toolchain runs in a container,
+// container paths are converted to host paths, and the system headers of the
+// toolchain are copied to the host, so that tools like clangd can use the
+// database.
+func generateCompiledb(makeArgs []string, output string) {
+	root := findProjectRoot()
+	native := findToolchain().Name() == TOOLCHAIN_NATIVE
+
+	progress("Collecting compiler commands...\n")
+	args := append([]string{"make", "-B", "-n", "-w"}, makeArgs...)
+	out, err := captureToolchain(args...)
+	if err != nil {
+		fatal("error running make: %v\n", err)
+	}
+
+	var dir string
+	var mappings []pathMapping
+	if native {
+		dir, _ = filepath.Abs(".")
+	} else {
+		dir = containerWorkdir(root)
+		mappings = containerPathMappings(root)
+	}
+	commands := parseCompileCommands(out, dir)
+	if len(commands) == 0 {
+		fatal("no compiler commands found in the build\n")
+	}
+
+	// Make the system headers available, and tell tools where they are,
+	// as they cannot ask the compiler itself.
+	includes, headers := toolchainHeaders()
+	mappings = append(mappings, headers...)
+	sort.SliceStable(mappings, func(i, j int) bool {
+		return len(mappings[i].container) > len(mappings[j].container)
+	})
+	sysargs := []string{"-nostdinc"}
+	for _, inc := range includes {
+		sysargs = append(sysargs, "-isystem", inc)
+	}
+
+	for i := range commands {
+		cc := &commands[i]
+		cc.Directory = mapPath(cc.Directory, mappings)
+		cc.File = mapArg(cc.File, mappings)
+		cc.Output = mapArg(cc.Output, mappings)
+		var args []string
+		for _, arg := range cc.Arguments {
+			args = append(args, mapArg(arg, mappings))
+		}
+		cc.Arguments = append(args, sysargs...)
+	}
+
+	data, err := json.MarshalIndent(commands, "", "  ")
+	if err == nil {
+		err = os.WriteFile(output, append(data, '\n'), 0666)
+	}
+	if err != nil {
+		fatal("error writing %s: %v\n", output, err)
+	}
+	progress("Written %d compiler commands to %s\n", len(commands), output)
+}
+
+// defaultCompiledbFile returns the default path of the compilation database:
+// the root of the repository, where tools look for it.
+func defaultCompiledbFile() string {
+	return filepath.Join(findProjectRoot(), "compile_commands.json")
+}
+
+func doCompiledb(cmd *cobra.Command, args []string) error {
+	// Make sure the installed libdragon headers match the vendored ones.
+	if err := autoInstallLibdragon(); err != nil {
+		return err
+	}
+
+	output := flagCompiledbOutput
+	if output == "" {
+		output = defaultCompiledbFile()
+	}
+	generateCompiledb(args, output)
+	return nil
+}
+
+var cmdCompiledb = &cobra.Command{
+	Use:   "compiledb [make args...]",
+	Short: "Generate a compilation database (compile_commands.json) for clangd and IDEs.",
+	Long: `This command records the compiler commands run by the build system, and writes
+them in a compilation database (compile_commands.json), that is used by clangd
+and IDEs to index the source code.
+
+Paths within the container are converted to host paths, and the system headers
+of the toolchain are copied to a cache directory on the host, so that they can
+be found by the tools. The build itself is not run.`,
+	Example: `  libdragon compiledb
+	-- generate compile_commands.json in the root of the repository
+  libdragon make --compiledb
+	-- build, and then update compile_commands.json`,
+	RunE:         doCompiledb,
+	SilenceUsage: true,
+}
+
+func init() {
+	cmdCompiledb.Flags().SetInterspersed(false)
+	cmdCompiledb.Flags().StringVarP(&flagCompiledbOutput, "output", "o", "", "path of the compilation database (default: compile_commands.json in the git root)")
+	rootCmd.AddCommand(cmdCompiledb)
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitShellWords(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"gcc -c main.c", []string{"gcc", "-c", "main.c"}},
+		{"  gcc\t-c  main.c  ", []string{"gcc", "-c", "main.c"}},
+		{`gcc -c "a b.c" -o 'x y.o'`, []string{"gcc", "-c", "a b.c", "-o", "x y.o"}},
+		{`echo "" ''`, []string{"echo", "", ""}},
+		{`-DNAME="\"game\""`, []string{`-DNAME="game"`}},
+		{`-DNAME='"game"'`, []string{`-DNAME="game"`}},
+		{`'a\b' "a\b" a\b`, []string{`a\b`, `a\b`, "ab"}},
+		{`"\$HOME" "\` + "`" + `x"`, []string{"$HOME", "`x"}},
+		{`a\ b c`, []string{"a b", "c"}},
+		{"gcc \\\n  -c main.c", []string{"gcc", "-c", "main.c"}},
+		{"a;b && c|d || e & f", []string{"a", ";", "b", "&&", "c", "|", "d", "||", "e", "&", "f"}},
+		{`echo "a;b" 'c&&d'`, []string{"echo", "a;b", "c&&d"}},
+		{`echo 'unterminated`, []string{"echo", "unterminated"}},
+	}
+	for _, tt := range tests {
+		if got := splitShellWords(tt.line); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitShellWords(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestParseCompileCommands(t *testing.T) {
+	output := `make: Entering directory '/app'
+mips64-elf-gcc -c -o build/main.o src/main.c
+make -C sub
+make[1]: Entering directory '/app/sub'
+mkdir -p build && mips64-elf-gcc -I inc \
+	-c x.c -o build/x.o
+make[1]: Leaving directory '/app/sub'
+CCACHE_DIR=/tmp gcc -c 'my file.cpp'; echo done
+gcc -o game build/main.o build/x.o
+gcc -MF dep.c -c z.c
+make[1]: Entering directory ` + "`/app/old'" + `
+cc -c old.c
+make[1]: Leaving directory ` + "`/app/old'" + `
+make: Leaving directory '/app'
+`
+	want := []compileCommand{
+		{Directory: "/app", Arguments: []string{"mips64-elf-gcc", "-c", "-o", "build/main.o", "src/main.c"}, File: "src/main.c", Output: "build/main.o"},
+		{Directory: "/app/sub", Arguments: []string{"mips64-elf-gcc", "-I", "inc", "-c", "x.c", "-o", "build/x.o"}, File: "x.c", Output: "build/x.o"},
+		{Directory: "/app", Arguments: []string{"gcc", "-c", "my file.cpp"}, File: "my file.cpp"},
+		{Directory: "/app", Arguments: []string{"gcc", "-MF", "dep.c", "-c", "z.c"}, File: "z.c"},
+		{Directory: "/app/old", Arguments: []string{"cc", "-c", "old.c"}, File: "old.c"},
+	}
+	got := parseCompileCommands([]byte(output), "/app")
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCompileCommands:\ngot  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestParseCompileCommandsUnbalancedDirectories(t *testing.T) {
+	// More directories left than entered (eg: with output truncated at
+	// the beginning): the starting directory is kept.
+	output := `make[1]: Leaving directory '/app/sub'
+gcc -c main.c
+`
+	got := parseCompileCommands([]byte(output), "/app")
+	if len(got) != 1 || got[0].Directory != "/app" {
+		t.Errorf("parseCompileCommands = %+v, want a command in /app", got)
+	}
+}
+
+func TestCacheDirName(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"sha256:0123abcd", "0123abcd"},
+		{"ghcr.io/dragonminded/libdragon:latest", "ghcr.io_dragonminded_libdragon_latest"},
+		{"image@sha256:0123", "image_sha256_0123"},
+	}
+	for _, tt := range tests {
+		if got := cacheDirName(tt.in); got != tt.want {
+			t.Errorf("cacheDirName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// projectConfig is the configuration of a libdragon project. It is stored in
+// CONFIG_FILE at the project root, which is meant to be committed. The same
+// format is also used for the user configuration (see userConfigFile), which
+// provides defaults for all projects.
+type projectConfig struct {
+	Toolchain toolchainConfig         `toml:"toolchain,omitempty"`
+	Libdragon vendorConfig            `toml:"libdragon,omitempty"`
+	Deps      map[string]vendorConfig `toml:"deps,omitempty"`
+	Make      makeConfig              `toml:"make,omitempty"`
+	Run       runConfig               `toml:"run,omitempty"`
+	Mounts    []mountConfig           `toml:"mounts,omitempty"`
+	Env       map[string]string       `toml:"env,omitempty"`
+}
+
+// toolchainConfig configures the toolchain used to build the project.
+type toolchainConfig struct {
+	Mode     string `toml:"mode,omitempty"`    // TOOLCHAIN_CONTAINER or TOOLCHAIN_NATIVE
+	Image    string `toml:"image,omitempty"`   // container image
+	Runtime  string `toml:"runtime,omitempty"` // container runtime (default: autodetect)
+	HostUser *bool  `toml:"host_user"`         // run container processes as host user (default: true)
+}
+
+// vendorConfig describes how a library is vendored in the project.
+type vendorConfig struct {
+	Remote string `toml:"remote,omitempty"` // upstream git URL
+	Branch string `toml:"branch,omitempty"` // upstream branch
+	Ref    string `toml:"ref,omitempty"`    // upstream tag or commit the library is pinned to
+	Path   string `toml:"path,omitempty"`   // repo-relative path of the vendored copy
+	Mode   string `toml:"mode,omitempty"`   // VENDOR_SUBTREE, VENDOR_SUBMODULE or VENDOR_TARBALL
+
+	// Tarball vendoring only
+	Archive  string `toml:"archive,omitempty"`  // URL or path of the source archive (default: from remote)
+	Version  string `toml:"version,omitempty"`  // version of the vendored archive
+	Checksum string `toml:"checksum,omitempty"` // checksum of the vendored archive
+}
+
+// makeConfig configures how "libdragon make" runs the build system.
+type makeConfig struct {
+	Jobs int `toml:"jobs,omitempty"` // parallel jobs (default: number of CPUs; 1 disables parallel builds)
+}
+
+// runConfig configures how "libdragon run" launches the ROM.
+type runConfig struct {
+	Emulator string `toml:"emulator,omitempty"` // emulator command line, with {rom} replaced by the ROM path
+}
+
+// mountConfig describes an additional directory to mount in the container.
+type mountConfig struct {
+	Source   string `toml:"source"`             // host path (relative to the project root)
+	Target   string `toml:"target"`             // container path
+	ReadOnly bool   `toml:"readonly,omitempty"` // mount as read-only
+}
+
+var (
+	cachedConfig        *projectConfig
+	cachedProjectConfig *projectConfig
+)
+
+// configFile returns the path of the project configuration file.
+func configFile() string {
+	return filepath.Join(findProjectRoot(), CONFIG_FILE)
+}
+
+// userConfigFile returns the path of the user configuration file, or an empty
+// string if the user configuration directory cannot be determined.
+func userConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "libdragon", USER_CONFIG_FILE)
+}
+
+// decodeConfigFile decodes a configuration file into cfg. Only the options
+// present in the file are modified, so that it can be used to layer multiple
+// files. A missing file is not an error.
+func decodeConfigFile(path string, cfg *projectConfig) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, err := toml.Decode(string(data), cfg); err != nil {
+		return err
+	}
+	return nil
+}
+
+// writeConfigFile writes a configuration file.
+func writeConfigFile(path string, cfg *projectConfig) error {
+	var buf bytes.Buffer
+	buf.WriteString("# libdragon project configuration. See https://github.com/rasky/libdragon-cli\n\n")
+	enc := toml.NewEncoder(&buf)
+	enc.Indent = ""
+	if err := enc.Encode(cfg); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0666)
+}
+
+// projectConfigForUpdate returns the project configuration as stored in the
+// project file (without user defaults), so that it can be modified and then
+// saved with saveProjectConfig. Settings stored for the project by older
+// versions are included, so that they are migrated when it is saved.
+func projectConfigForUpdate() *projectConfig {
+	if cachedProjectConfig == nil {
+		cfg := &projectConfig{}
+		readLegacyProjectConfig(cfg)
+		if err := decodeConfigFile(configFile(), cfg); err != nil {
+			fatal("error reading %s: %v\n", CONFIG_FILE, err)
+		}
+		cachedProjectConfig = cfg
+	}
+	return cachedProjectConfig
+}
+
+// saveProjectConfig saves the project configuration, as modified after a call
+// to projectConfigForUpdate. The vendoring of libdragon is recorded too, if it
+// was detected (see findLibdragon), and the settings stored by older versions
+// are removed, as they are now part of the configuration.
+func saveProjectConfig() {
+	cfg := projectConfigForUpdate()
+	if cfg.Libdragon.Path == "" {
+		if path, mode := findLibdragon(); path != "" {
+			setLibdragonVendoring(path, mode)
+			return
+		}
+	}
+
+	if err := writeConfigFile(configFile(), cfg); err != nil {
+		fatal("error writing %s: %v\n", CONFIG_FILE, err)
+	}
+	if removeLegacyProjectConfig() {
+		progress("Migrated project settings to %s\n", CONFIG_FILE)
+	}
+	// Invalidate the effective configuration
+	cachedConfig = nil
+}
+
+// config returns the effective configuration for the current project: the
+// user configuration, overridden by the project configuration. Settings stored
+// for the project by older versions are honored, but they are migrated only
+// when the project configuration is saved.
+func config() *projectConfig {
+	if cachedConfig == nil {
+		cfg := &projectConfig{}
+		if path := userConfigFile(); path != "" {
+			if err := decodeConfigFile(path, cfg); err != nil {
+				fatal("error reading %s: %v\n", path, err)
+			}
+		}
+		readLegacyProjectConfig(cfg)
+		if err := decodeConfigFile(configFile(), cfg); err != nil {
+			fatal("error reading %s: %v\n", CONFIG_FILE, err)
+		}
+		if cfg.Libdragon.Remote == "" {
+			cfg.Libdragon.Remote = LIBDRAGON_GIT
+		}
+		if cfg.Libdragon.Branch == "" {
+			cfg.Libdragon.Branch = LIBDRAGON_BRANCH
+		}
+		cachedConfig = cfg
+	}
+	return cachedConfig
+}
+
+// configEnv returns the environment variables configured for the toolchain,
+// in "VAR=value" format, sorted by name.
+func configEnv() []string {
+	var env []string
+	for k, v := range config().Env {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// readLegacyProjectConfig reads into cfg the project settings stored by older
+// versions: the toolchain image, in a file in the project root.
+func readLegacyProjectConfig(cfg *projectConfig) {
+	if imagebytes, err := os.ReadFile(filepath.Join(findProjectRoot(), CACHED_IMAGE_FILE)); err == nil {
+		cfg.Toolchain.Image = strings.TrimSpace(string(imagebytes))
+	}
+}
+
+// removeLegacyProjectConfig removes the project settings stored by older
+// versions (see readLegacyProjectConfig). It returns true if there were any.
+func removeLegacyProjectConfig() bool {
+	return os.Remove(filepath.Join(findProjectRoot(), CACHED_IMAGE_FILE)) == nil
+}
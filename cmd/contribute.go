@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagContributeBranch string
+	flagContributePush   bool
+)
+
+// libdragonHistoryDir returns the git repository containing the local
+// libdragon history: the submodule, or the project repository for subtrees.
+func libdragonHistoryDir(path string, submodule bool) string {
+	if submodule {
+		return filepath.Join(mustFindGitRoot(), path)
+	}
+	return mustFindGitRoot()
+}
+
+// localLibdragonHead returns the commit at the tip of the local libdragon
+// history, in the repository returned by libdragonHistoryDir. For subtrees,
+// the history is extracted from the project history with "git subtree split",
+// which needs the upstream commits that were squashed into it: they must have
+// been fetched first.
+func localLibdragonHead(path string, submodule bool) string {
+	dir := libdragonHistoryDir(path, submodule)
+	if submodule {
+		return mustOutput("git", "-C", dir, "rev-parse", "HEAD")[0]
+	}
+
+	progress("Extracting libdragon history from %s...\n", path)
+	out, err := getOutput("git", "-C", dir, "subtree", "split", "-q", "--prefix", filepath.ToSlash(path), "HEAD")
+	if err != nil {
+		fatal_exitproc(err, "git", []string{"subtree", "split", "--prefix", path})
+	}
+	return strings.TrimSpace(out[0])
+}
+
+// unmergedCommits returns the commits of head which are not in base, in the
+// order they should be applied. Commits whose changes are already in base
+// (eg: fixes that were already accepted upstream) are skipped.
+func unmergedCommits(dir, base, head string) []string {
+	var commits []string
+	for _, line := range mustOutput("git", "-C", dir, "cherry", base, head) {
+		if strings.HasPrefix(line, "+ ") {
+			commits = append(commits, line[2:])
+		}
+	}
+	return commits
+}
+
+// createBranchWithCommits creates a new branch starting at base, and
+// cherry-picks the specified commits on it. The work is done in a temporary
+// worktree, so that the working tree of the project is not touched.
+func createBranchWithCommits(dir, branch, base string, commits []string) {
+	tmp, err := os.MkdirTemp("", "libdragon-contribute")
+	if err != nil {
+		fatal("%v\n", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := run("git", "-C", dir, "worktree", "add", "-q", "-b", branch, tmp, base); err != nil {
+		fatal("cannot create branch %s (use --branch to choose a different name)\n", branch)
+	}
+	defer run("git", "-C", dir, "worktree", "remove", "--force", tmp)
+
+	args := append([]string{"-C", tmp, "cherry-pick"}, commits...)
+	if err := run("git", args...); err != nil {
+		run("git", "-C", tmp, "cherry-pick", "--abort")
+		run("git", "-C", dir, "worktree", "remove", "--force", tmp)
+		run("git", "-C", dir, "branch", "-D", branch)
+		fatal("local libdragon commits conflict with upstream changes: update libdragon first\n")
+	}
+}
+
+func doContribute(cmd *cobra.Command, args []string) error {
+	path, submodule := mustFindGitLibdragon()
+	cfg := config()
+
+	dir := libdragonHistoryDir(path, submodule)
+
+	// Fetch the current upstream, to base the branch on it. This also
+	// brings in the upstream commits needed to split a squashed subtree.
+	spawn("git", "-C", dir, "fetch", cfg.Libdragon.Remote, cfg.Libdragon.Branch)
+	base := mustOutput("git", "-C", dir, "rev-parse", "FETCH_HEAD^{commit}")[0]
+	head := localLibdragonHead(path, submodule)
+
+	commits := unmergedCommits(dir, base, head)
+	if len(commits) == 0 {
+		progress("No local changes to libdragon to contribute\n")
+		return nil
+	}
+	createBranchWithCommits(dir, flagContributeBranch, base, commits)
+	progress("Created branch %s with %d commits on top of %s (%s)\n",
+		flagContributeBranch, len(commits), cfg.Libdragon.Remote, cfg.Libdragon.Branch)
+	spawn("git", "--no-pager", "-C", dir, "log", "--oneline", base+".."+flagContributeBranch)
+
+	pushArgs := []string{"-C", dir, "push", "<fork>", flagContributeBranch}
+	if len(args) > 0 {
+		pushArgs[3] = args[0]
+		if flagContributePush {
+			spawn("git", pushArgs...)
+			return nil
+		}
+	}
+	progress("To push it to your fork, run:\n")
+	progress("  git %s\n", strings.Join(pushArgs, " "))
+	return nil
+}
+
+var cmdContribute = &cobra.Command{
+	Use:   "contribute [fork]",
+	Short: "Prepare a branch with local libdragon changes, to send them upstream.",
+	Long: `This command extracts the local commits made to the vendored libdragon copy,
+and creates a branch with them on top of the current upstream libdragon, ready
+to be pushed to your fork of libdragon (specified as a git URL or remote name),
+so that a pull request can be opened.
+
+With subtree vendoring, the libdragon commits are extracted from the project
+history with "git subtree split"; with submodule vendoring, the branch is
+created within the submodule.`,
+	Example: `  libdragon contribute
+	-- create the libdragon-contrib branch with the local libdragon changes
+  libdragon contribute git@github.com:user/libdragon.git --push
+	-- same, and push it to a fork`,
+	Args:         cobra.MaximumNArgs(1),
+	RunE:         doContribute,
+	SilenceUsage: true,
+}
+
+func init() {
+	cmdContribute.Flags().StringVarP(&flagContributeBranch, "branch", "b", "libdragon-contrib", "name of the branch to create")
+	cmdContribute.Flags().BoolVarP(&flagContributePush, "push", "", false, "push the branch to the fork")
+	rootCmd.AddCommand(cmdContribute)
+}
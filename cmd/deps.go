@@ -0,0 +1,315 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gookit/color"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagDepsPath      string
+	flagDepsRemote    string
+	flagDepsBranch    string
+	flagDepsRef       string
+	flagDepsSubmodule bool
+)
+
+// sortedDepNames returns the names of the dependencies in the lockfile, sorted.
+func sortedDepNames(deps map[string]*vendorLock) []string {
+	var names []string
+	for name := range deps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// configDepNames returns the names of the dependencies in the configuration,
+// sorted.
+func configDepNames() []string {
+	var names []string
+	for name := range config().Deps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mustFindDep returns the configuration of the specified dependency, and
+// aborts with fatal if it does not exist.
+func mustFindDep(name string) vendorConfig {
+	dep, found := config().Deps[name]
+	if !found {
+		fatal("unknown dependency: %s (see: libdragon deps list)\n", name)
+	}
+	return dep
+}
+
+// depRepo returns the vendoredRepo for a dependency.
+func depRepo(name string, dep vendorConfig) vendoredRepo {
+	return vendoredRepo{name: name, path: dep.Path, submodule: dep.Mode == VENDOR_SUBMODULE}
+}
+
+// depPatchesDir returns the directory where local commits to a dependency are
+// exported to, before updating it.
+func depPatchesDir(name string) string {
+	return filepath.Join(mustFindGitRoot(), name+"-patches")
+}
+
+// saveDep records a dependency in the project configuration and its vendored
+// version in the lockfile. If dep is nil, the dependency is removed.
+func saveDep(name string, dep *vendorConfig, lock *vendorLock) {
+	pcfg := projectConfigForUpdate()
+	if dep != nil {
+		if pcfg.Deps == nil {
+			pcfg.Deps = make(map[string]vendorConfig)
+		}
+		pcfg.Deps[name] = *dep
+	} else {
+		delete(pcfg.Deps, name)
+	}
+	saveProjectConfig()
+
+	lf := readLockFile()
+	if lock != nil {
+		if lf.Deps == nil {
+			lf.Deps = make(map[string]*vendorLock)
+		}
+		lf.Deps[name] = lock
+	} else {
+		delete(lf.Deps, name)
+	}
+	writeLockFile(lf)
+}
+
+// defaultBranch returns the default branch of a remote git repository.
+func defaultBranch(remote string) string {
+	out, err := getOutput("git", "ls-remote", "--symref", remote, "HEAD")
+	if err == nil {
+		for _, line := range out {
+			if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "ref:" {
+				return strings.TrimPrefix(fields[1], "refs/heads/")
+			}
+		}
+	}
+	fatal("cannot find the default branch of %s (use --branch to specify it)\n", remote)
+	return ""
+}
+
+func doDepsAdd(cmd *cobra.Command, args []string) error {
+	repoRoot := mustFindGitRoot()
+	name, remote := args[0], args[1]
+	if name == "libdragon" {
+		fatal("libdragon is managed with libdragon init and libdragon update\n")
+	}
+	if _, found := config().Deps[name]; found {
+		fatal("dependency %s already exists (use: libdragon deps update %s)\n", name, name)
+	}
+
+	dep := vendorConfig{
+		Remote: remote,
+		Branch: flagDepsBranch,
+		Ref:    flagDepsRef,
+		Path:   flagDepsPath,
+		Mode:   VENDOR_SUBTREE,
+	}
+	if dep.Path == "" {
+		dep.Path = name
+	}
+	dep.Path = filepath.ToSlash(dep.Path)
+	if _, err := os.Stat(filepath.Join(repoRoot, dep.Path)); err == nil {
+		fatal("%s already exists\n", dep.Path)
+	}
+	if dep.Branch == "" {
+		dep.Branch = defaultBranch(remote)
+	}
+
+	var upstream string
+	if flagDepsSubmodule {
+		dep.Mode = VENDOR_SUBMODULE
+		spawn("git", "-C", repoRoot, "submodule", "add",
+			"--name", name,
+			"--branch", dep.Branch,
+			"--", remote, dep.Path)
+		submodulePath := filepath.Join(repoRoot, dep.Path)
+		if dep.Ref != "" {
+			commit := fetchUpstream(submodulePath, "origin", dep.Branch, dep.Ref)
+			spawn("git", "-C", submodulePath, "checkout", "--detach", commit)
+			spawn("git", "-C", repoRoot, "add", "--", dep.Path)
+		}
+		upstream = mustOutput("git", "-C", submodulePath, "rev-parse", "HEAD")[0]
+	} else {
+		// See doInit: git subtree does not work in an empty repository.
+		if _, err := getOutput("git", "-C", repoRoot, "rev-parse", "HEAD"); err != nil {
+			mustRun("git", "-C", repoRoot, "commit", "--allow-empty", "-n", "-m", "Initial commit.")
+		}
+		upstream = fetchUpstream(repoRoot, remote, dep.Branch, dep.Ref)
+		spawn("git", "-C", repoRoot, "subtree", "add", "--prefix", dep.Path, "--squash", upstream)
+	}
+
+	saveDep(name, &dep, &vendorLock{
+		Remote:   remote,
+		Commit:   upstream,
+		Vendored: vendoredHash(dep.Path, dep.Mode),
+	})
+	progress("Added %s in %s\n", name, dep.Path)
+	return nil
+}
+
+func doDepsUpdate(cmd *cobra.Command, args []string) error {
+	names := args
+	if len(names) == 0 {
+		names = configDepNames()
+	}
+	refSet := cmd.Flags().Changed("ref")
+	if (flagDepsRemote != "" || flagDepsBranch != "" || refSet) && len(names) != 1 {
+		fatal("--remote, --branch and --ref can only be used when updating a single dependency\n")
+	}
+
+	for _, name := range names {
+		dep := mustFindDep(name)
+		remote, branch, ref := dep.Remote, dep.Branch, dep.Ref
+		if flagDepsRemote != "" {
+			remote = flagDepsRemote
+		}
+		if flagDepsBranch != "" {
+			branch = flagDepsBranch
+		}
+		if refSet {
+			ref = flagDepsRef
+		}
+
+		color.Greenp("Updating " + name + "...\n")
+		lib := depRepo(name, dep)
+		head := gitHead(mustFindGitRoot())
+		upstream, ok := lib.update(dep, remote, branch, ref, depPatchesDir(name))
+		if !ok {
+			continue
+		}
+		dep.Remote, dep.Branch, dep.Ref = remote, branch, ref
+		saveDep(name, &dep, &vendorLock{
+			Remote:   remote,
+			Commit:   upstream,
+			Vendored: vendoredHash(dep.Path, dep.Mode),
+		})
+		lib.commitUpdate(head)
+	}
+	return nil
+}
+
+func doDepsRemove(cmd *cobra.Command, args []string) error {
+	repoRoot := mustFindGitRoot()
+	name := args[0]
+	dep := mustFindDep(name)
+
+	if dep.Mode == VENDOR_SUBMODULE {
+		os.RemoveAll(removeSubmodule(repoRoot, dep.Path))
+	} else {
+		spawn("git", "-C", repoRoot, "rm", "-r", "-q", "--", dep.Path)
+	}
+	saveDep(name, nil, nil)
+	progress("Removed %s from %s. Commit the changes to complete the removal.\n", name, dep.Path)
+	return nil
+}
+
+func doDepsList(cmd *cobra.Command, args []string) error {
+	names := configDepNames()
+	if len(names) == 0 {
+		progress("No dependencies (add one with: libdragon deps add)\n")
+		return nil
+	}
+
+	repoRoot := mustFindGitRoot()
+	for _, name := range names {
+		dep := config().Deps[name]
+		upstream := dep.Branch
+		if dep.Ref != "" {
+			upstream = "pinned to " + dep.Ref
+		}
+
+		var commit string
+		if dep.Mode == VENDOR_SUBMODULE {
+			if out, err := getOutput("git", "-C", filepath.Join(repoRoot, dep.Path), "rev-parse", "HEAD"); err == nil {
+				commit = out[0]
+			}
+		} else {
+			commit = findSubtreeSplit(dep.Path)
+		}
+
+		fmt.Printf("%s %s (%s)\n", color.Green.Render(name+":"), dep.Path, dep.Mode)
+		fmt.Printf("  remote: %s (%s)\n", dep.Remote, upstream)
+		fmt.Printf("  commit: %s\n", orUnknown(commit))
+	}
+	return nil
+}
+
+var cmdDeps = &cobra.Command{
+	Use:   "deps",
+	Short: "Manage additional libraries vendored in the current repository.",
+	Long: `This command manages additional libraries (eg: 3D engines or audio libraries)
+vendored in the repository, in the same way libdragon is. Each dependency has a
+name, and is vendored with git subtree (default) or git submodule from its own
+remote and branch, optionally pinned to a tag or commit. They are recorded in
+the [deps] section of the project configuration.`,
+	Example: `  libdragon deps add tiny3d https://github.com/HailToDodongo/tiny3d
+	-- vendor tiny3d in the tiny3d directory
+  libdragon deps update
+	-- update all dependencies
+  libdragon deps update tiny3d --ref v1.0
+	-- pin tiny3d to a specific tag`,
+	Args:         cobra.NoArgs,
+	RunE:         doDepsList,
+	SilenceUsage: true,
+}
+
+var cmdDepsAdd = &cobra.Command{
+	Use:          "add <name> <remote>",
+	Short:        "Vendor a new dependency from a git repository.",
+	Args:         cobra.ExactArgs(2),
+	RunE:         doDepsAdd,
+	SilenceUsage: true,
+}
+
+var cmdDepsUpdate = &cobra.Command{
+	Use:          "update [name...]",
+	Short:        "Update vendored dependencies (default: all).",
+	RunE:         doDepsUpdate,
+	SilenceUsage: true,
+}
+
+var cmdDepsRemove = &cobra.Command{
+	Use:          "remove <name>",
+	Short:        "Remove a vendored dependency.",
+	Args:         cobra.ExactArgs(1),
+	RunE:         doDepsRemove,
+	SilenceUsage: true,
+}
+
+var cmdDepsList = &cobra.Command{
+	Use:          "list",
+	Short:        "List vendored dependencies.",
+	Args:         cobra.NoArgs,
+	RunE:         doDepsList,
+	SilenceUsage: true,
+}
+
+func init() {
+	cmdDepsAdd.Flags().StringVarP(&flagDepsPath, "path", "p", "", "repo-relative path where to vendor the dependency (default: its name)")
+	cmdDepsAdd.Flags().StringVarP(&flagDepsBranch, "branch", "b", "", "branch to vendor (default: the default branch of the remote)")
+	cmdDepsAdd.Flags().StringVarP(&flagDepsRef, "ref", "r", "", "pin the dependency to a tag or commit")
+	cmdDepsAdd.Flags().BoolVarP(&flagDepsSubmodule, "submodule", "m", false, "use git submodule instead of git subtree")
+
+	cmdDepsUpdate.Flags().StringVarP(&flagDepsRemote, "remote", "", "", "git URL to update from (saved for later updates)")
+	cmdDepsUpdate.Flags().StringVarP(&flagDepsBranch, "branch", "b", "", "branch to update from (saved for later updates)")
+	cmdDepsUpdate.Flags().StringVarP(&flagDepsRef, "ref", "r", "", "pin the dependency to a tag or commit (saved for later updates; use --ref= to unpin)")
+	cmdDepsUpdate.Flags().BoolVarP(&flagUpdateYes, "yes", "y", false, "update without asking for confirmation")
+	cmdDepsUpdate.Flags().BoolVarP(&flagUpdateDryRun, "dry-run", "n", false, "only show the changes, without updating anything")
+
+	cmdDeps.AddCommand(cmdDepsAdd, cmdDepsUpdate, cmdDepsRemove, cmdDepsList)
+	rootCmd.AddCommand(cmdDeps)
+}
@@ -10,32 +10,38 @@ var (
 	flagDisasmFile string
 )
 
-func doDisasm(cmd *cobra.Command, args []string) error {
-	if flagDisasmFile == "" {
-		root := findGitRootOrCwd()
+// findBuildOutput looks for build outputs matching the specified pattern (eg:
+// "*.elf"). It starts from the current directory and looks for them in either
+// the current directory or a "build" subdirectory, traversing the tree up until
+// git root (if any). It returns the matches found in the first directory that
+// has any, together with the directory itself.
+func findBuildOutput(pattern string) ([]string, string) {
+	root := findProjectRoot()
 
-		// Look for the file. We start from the current directory and look
-		// for files with ".elf" extension in either the current directory or
-		// a "build" subdirectory, traversing the tree up until git root (if any).
-		cwd := "."
-		var matches []string
-		for i := 0; i < 10; i++ {
-			matches, _ = filepath.Glob(filepath.Join(cwd, "*.elf"))
-			if len(matches) > 0 {
-				break
-			}
-			matches, _ = filepath.Glob(filepath.Join(cwd, "build", "*.elf"))
-			if len(matches) > 0 {
-				break
-			}
+	cwd := "."
+	var matches []string
+	for i := 0; i < 10; i++ {
+		matches, _ = filepath.Glob(filepath.Join(cwd, pattern))
+		if len(matches) > 0 {
+			break
+		}
+		matches, _ = filepath.Glob(filepath.Join(cwd, "build", pattern))
+		if len(matches) > 0 {
+			break
+		}
 
-			cwdAbs, _ := filepath.Abs(cwd)
-			if cwdAbs == root || cwdAbs == "/" {
-				break
-			}
-			cwd = filepath.Join(cwd, "..")
+		cwdAbs, _ := filepath.Abs(cwd)
+		if cwdAbs == root || cwdAbs == "/" {
+			break
 		}
+		cwd = filepath.Join(cwd, "..")
+	}
+	return matches, cwd
+}
 
+func doDisasm(cmd *cobra.Command, args []string) error {
+	if flagDisasmFile == "" {
+		matches, cwd := findBuildOutput("*.elf")
 		if len(matches) == 0 {
 			fatal("cannot find ELF file to disassemble -- use --file to specify\n")
 		}
@@ -55,8 +61,7 @@ func doDisasm(cmd *cobra.Command, args []string) error {
 	}
 	dockerArgs = append(dockerArgs, flagDisasmFile)
 
-	spawnDockerExec(dockerArgs...)
-	return nil
+	return spawnToolchain(dockerArgs...)
 }
 
 var cmdDisasm = &cobra.Command{
@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+// editors is the list of editors supported by "libdragon editor".
+var editors = []string{"vscode"}
+
+// gccProblemMatcher is a VS Code problem matcher for the diagnostics of gcc.
+// Container paths in the output of the toolchain are rewritten to host paths,
+// so they can be either absolute host paths, or relative to the directory
+// where make is run.
+var gccProblemMatcher = map[string]interface{}{
+	"owner":        "libdragon",
+	"source":       "gcc",
+	"fileLocation": []interface{}{"autoDetect", "${workspaceFolder}"},
+	"pattern": map[string]interface{}{
+		"regexp":   `^(.*?):(\d+):(\d*):?\s+(?:fatal\s+)?(warning|error|note):\s+(.*)$`,
+		"file":     1,
+		"line":     2,
+		"column":   3,
+		"severity": 4,
+		"message":  5,
+	},
+}
+
+// stripJSONComments removes comments and trailing commas from a JSON document,
+// as they are allowed in VS Code configuration files.
+func stripJSONComments(data []byte) []byte {
+	var out []byte
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '"':
+			// Copy strings verbatim
+			j := i + 1
+			for j < len(data) && data[j] != '"' {
+				if data[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(data) {
+				j = len(data) - 1
+			}
+			out = append(out, data[i:j+1]...)
+			i = j
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			i--
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				return out
+			}
+			i += end + 3
+		case c == '}' || c == ']':
+			// Remove a trailing comma before the closing bracket
+			trimmed := bytes.TrimRight(out, " \t\r\n")
+			if len(trimmed) > 0 && trimmed[len(trimmed)-1] == ',' {
+				out = append(trimmed[:len(trimmed)-1], out[len(trimmed):]...)
+			}
+			out = append(out, c)
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// readJSONFile reads a JSON object from a VS Code configuration file. A missing
+// file is returned as an empty object.
+func readJSONFile(path string) (map[string]interface{}, error) {
+	obj := make(map[string]interface{})
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return obj, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(stripJSONComments(data), &obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// mergeJSONList merges a list of objects into the list stored under key in obj.
+// Existing objects with the same value of idKey are replaced, and the others
+// are appended, so that the objects added by the user are preserved.
+func mergeJSONList(obj map[string]interface{}, key string, idKey string, items []map[string]interface{}) {
+	list, _ := obj[key].([]interface{})
+	for _, item := range items {
+		replaced := false
+		for i, old := range list {
+			if old, ok := old.(map[string]interface{}); ok && old[idKey] == item[idKey] {
+				list[i] = item
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			list = append(list, item)
+		}
+	}
+	obj[key] = list
+}
+
+// updateJSONFile merges a list of objects into a VS Code configuration file,
+// creating it if it does not exist (see mergeJSONList).
+func updateJSONFile(path string, version interface{}, key string, idKey string, items []map[string]interface{}) {
+	obj, err := readJSONFile(path)
+	if err != nil {
+		fatal("error reading %s: %v\n", path, err)
+	}
+	if _, found := obj["version"]; !found {
+		obj["version"] = version
+	}
+	mergeJSONList(obj, key, idKey, items)
+
+	data, err := json.MarshalIndent(obj, "", "\t")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0777)
+	}
+	if err == nil {
+		err = os.WriteFile(path, append(data, '\n'), 0666)
+	}
+	if err != nil {
+		fatal("error writing %s: %v\n", path, err)
+	}
+	progress("Updated %s\n", path)
+}
+
+// libdragonTask returns a VS Code task that runs a libdragon command.
+func libdragonTask(label string, args ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"label":          label,
+		"type":           "process",
+		"command":        "libdragon",
+		"args":           args,
+		"options":        map[string]interface{}{"cwd": "${workspaceFolder}"},
+		"problemMatcher": gccProblemMatcher,
+	}
+}
+
+// generateVSCode writes the VS Code configuration for the project: tasks to
+// build it, the IntelliSense configuration for the C/C++ extension, and a
+// launch configuration to run it.
+func generateVSCode() {
+	dir := filepath.Join(findProjectRoot(), ".vscode")
+
+	build := libdragonTask("libdragon: make", "make")
+	build["group"] = map[string]interface{}{"kind": "build", "isDefault": true}
+	updateJSONFile(filepath.Join(dir, "tasks.json"), "2.0.0", "tasks", "label", []map[string]interface{}{
+		build,
+		libdragonTask("libdragon: clean", "make", "clean"),
+		libdragonTask("libdragon: compiledb", "compiledb"),
+	})
+
+	// IntelliSense uses the compilation database when available (see
+	// "libdragon compiledb"); otherwise, it falls back to the include
+	// paths, which point to the copy of the toolchain headers on the host.
+	includes, _ := toolchainHeaders()
+	includePath := []string{"${workspaceFolder}/**"}
+	for _, inc := range includes {
+		includePath = append(includePath, filepath.ToSlash(inc))
+	}
+	updateJSONFile(filepath.Join(dir, "c_cpp_properties.json"), 4, "configurations", "name", []map[string]interface{}{{
+		"name":            "libdragon",
+		"includePath":     includePath,
+		"defines":         []string{"N64"},
+		"cStandard":       "gnu99",
+		"cppStandard":     "gnu++17",
+		"compileCommands": "${workspaceFolder}/compile_commands.json",
+	}})
+
+	// Running is not debugging, but a launch configuration makes it
+	// available with F5 / Ctrl+F5. "libdragon run" builds the ROM first.
+	updateJSONFile(filepath.Join(dir, "launch.json"), "0.2.0", "configurations", "name", []map[string]interface{}{{
+		"name":    "libdragon: run",
+		"type":    "node-terminal",
+		"request": "launch",
+		"command": "libdragon run",
+		"cwd":     "${workspaceFolder}",
+	}})
+}
+
+// mustBeSupportedEditor aborts with fatal if the specified editor is not
+// supported.
+func mustBeSupportedEditor(editor string) {
+	for _, e := range editors {
+		if e == editor {
+			return
+		}
+	}
+	fatal("unsupported editor: %s (supported: %v)\n", editor, editors)
+}
+
+// generateEditorConfig writes the project configuration for the specified
+// editor.
+func generateEditorConfig(editor string) {
+	mustBeSupportedEditor(editor)
+	switch editor {
+	case "vscode":
+		generateVSCode()
+	}
+}
+
+func doEditor(cmd *cobra.Command, args []string) error {
+	generateEditorConfig(args[0])
+	return nil
+}
+
+var cmdEditor = &cobra.Command{
+	Use:   "editor <editor>",
+	Short: "Generate the project configuration for an editor.",
+	Long: fmt.Sprintf(`This command generates the project configuration for an editor, so that the
+project can be built from it, and build errors and code navigation work.
+Supported editors: %v.
+
+For VS Code, it writes tasks to build the project (in .vscode/tasks.json), the
+IntelliSense configuration (in .vscode/c_cpp_properties.json), and a launch
+configuration that runs the ROM in the emulator (in .vscode/launch.json).
+Existing files are merged: settings, tasks and configurations not generated by
+libdragon are kept. Comments in the existing files are not preserved.`, editors),
+	Example: `  libdragon editor vscode
+	-- generate the configuration for Visual Studio Code`,
+	Args:         cobra.ExactArgs(1),
+	ValidArgs:    editors,
+	RunE:         doEditor,
+	SilenceUsage: true,
+}
+
+func init() {
+	rootCmd.AddCommand(cmdEditor)
+}
@@ -1,16 +1,55 @@
 package cmd
 
 import (
+	"fmt"
+	"io"
+	"os"
 	"path"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
-func spawnDockerExec(args ...string) error {
-	root := findGitRootOrCwd()
-	container := searchContainer(root, true)
+// execOptions controls how a command is run within the toolchain.
+type execOptions struct {
+	interactive bool      // forward stdin to the command
+	tty         bool      // allocate a pseudo-TTY for the command
+	root        bool      // run the command as root (container only)
+	hostPaths   bool      // rewrite container paths to host paths in the output (container only)
+	output      io.Writer // if not nil, write the output of the command here instead of stdout
+}
+
+// defaultExecOptions returns the options to run a command within the toolchain,
+// matching the way libdragon itself was invoked: stdin is forwarded if it
+// is a terminal, and a TTY is allocated if both stdin and stdout are terminals.
+// Container paths in the output are rewritten to host paths, unless disabled
+// with --no-host-paths.
+func defaultExecOptions() execOptions {
+	stdinTerm := isTerminal(os.Stdin)
+	return execOptions{
+		interactive: stdinTerm,
+		tty:         stdinTerm && isTerminal(os.Stdout),
+		hostPaths:   !flagNoHostPaths,
+	}
+}
+
+// containerToolchain runs the toolchain within a container, associated to
+// the git root (or current directory).
+type containerToolchain struct{}
+
+func (t *containerToolchain) Name() string {
+	return TOOLCHAIN_CONTAINER
+}
 
+func (t *containerToolchain) ShellCommand() []string {
+	return []string{"bash"}
+}
+
+// containerWorkdir returns the path within the container that corresponds to
+// the current directory, when the specified root is mounted as VOLUME_ROOT.
+func containerWorkdir(root string) string {
 	// Reconstruct the relative path within the git root, so that it can be
 	// set as working directory in the docker container. If this fails,
 	// just avoid setting a working directory and hope for the best.
@@ -24,20 +63,117 @@ func spawnDockerExec(args ...string) error {
 			}
 		}
 	}
+	return workdir
+}
 
-	docker_args := []string{
-		"exec",
-		"--workdir", workdir,
-		container,
+// Exec runs a command within the toolchain container, using the current
+// directory (relative to the git root) as working directory.
+// If the command fails, an exitCodeError is returned with its exit code.
+func (t *containerToolchain) Exec(opts execOptions, args ...string) error {
+	root := findProjectRoot()
+	container := searchContainer(root, true)
+	workdir := containerWorkdir(root)
+
+	// Tag the command (and all its children, which inherit the environment)
+	// with a unique ID, so that they can be found if they must be stopped.
+	execID := fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+	env := append(configEnv(), EXEC_ID_VAR+"="+execID)
+
+	// Commands are run as the host user, unless root privileges are needed
+	// (eg: to write into the toolchain installation within the image).
+	user := hostUser()
+	if opts.root && user != "" {
+		user = "0:0"
 	}
-	docker_args = append(docker_args, args...)
 
-	spawn("docker", docker_args...)
+	rt := mustFindRuntime()
+	cmdline := rt.ExecArgs(container, opts, workdir, env, user, args)
+
+	forward := func(sig os.Signal) {
+		stopDockerExec(rt, container, execID, sig)
+	}
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if opts.output != nil {
+		stdout = opts.output
+	}
+	if opts.hostPaths {
+		mappings := containerPathMappings(root)
+		rw := newPathRewriters(mappings, stdout, stderr)
+		defer rw[0].Flush()
+		defer rw[1].Flush()
+		stdout, stderr = rw[0], rw[1]
+	}
+	code, err := spawnRedirect(forward, stdout, stderr, cmdline[0], cmdline[1:]...)
+	if err != nil {
+		// The runtime client itself could not be run.
+		fatal_exitproc(err, cmdline[0], cmdline[1:])
+	}
+	if code != 0 {
+		// The exec command uses the exit code to report both failures of
+		// the command and its own failures. Tell them apart by checking
+		// whether the container is still alive: if it is, the exit code
+		// is the command's one and must be forwarded as-is.
+		info, err := rt.InspectContainer(container)
+		if err != nil {
+			fatal("error: cannot reach %s container %s (is the %s daemon running?)\n", rt.Name(), container, rt.Name())
+		}
+		if !info.Running {
+			fatal("error: %s container %s is not running\n", rt.Name(), container)
+		}
+		return &exitCodeError{code}
+	}
 	return nil
 }
 
+// EXEC_ID_VAR is the environment variable used to tag processes started
+// within the container by containerToolchain.Exec.
+const EXEC_ID_VAR = "LIBDRAGON_EXEC_ID"
+
+// stopScript is a shell script run within the container to stop all processes
+// tagged with a certain exec ID ($1), sending them the specified signal ($2).
+// If they are still running after 5 seconds, they are killed.
+const stopScript = `
+list() {
+	grep -lzsxF "` + EXEC_ID_VAR + `=$1" /proc/[0-9]*/environ | sed 's|^/proc/\([0-9]*\)/environ$|\1|'
+}
+pids=$(list "$1")
+[ -z "$pids" ] && exit 0
+kill -s "$2" $pids 2>/dev/null
+i=0
+while [ $i -lt 50 ]; do
+	pids=$(list "$1")
+	[ -z "$pids" ] && exit 0
+	sleep 0.1
+	i=$((i+1))
+done
+kill -s KILL $pids 2>/dev/null
+`
+
+// stopDockerExec stops the processes started in the container by an exec
+// command. This is required because killing the exec client does not stop the
+// process that it started within the container, which would otherwise keep
+// running in background.
+func stopDockerExec(rt containerRuntime, container string, execID string, sig os.Signal) {
+	signame := "INT"
+	if sig == syscall.SIGTERM {
+		signame = "TERM"
+	}
+	vprintf("forwarding SIG%s to container processes\n", signame)
+	cmdline := rt.ExecArgs(container, execOptions{}, VOLUME_ROOT, nil, "",
+		[]string{"sh", "-c", stopScript, "sh", execID, signame})
+	if err := run(cmdline[0], cmdline[1:]...); err != nil {
+		critical("error stopping processes in container %s: %v\n", container, err)
+	}
+}
+
 func doExec(cmd *cobra.Command, args []string) error {
-	return spawnDockerExec(args...)
+	opts := defaultExecOptions()
+	if opts.tty {
+		// Interactive programs (eg: gdb, bash) redraw the terminal in
+		// ways that cannot be rewritten line by line.
+		opts.hostPaths = false
+	}
+	return findToolchain().Exec(opts, args...)
 }
 
 var cmdExec = &cobra.Command{
@@ -14,13 +14,29 @@ import (
 var (
 	flagInitForce         bool
 	flagInitUseSubmodules bool
+	flagInitRemote        string
+	flagInitBranch        string
+	flagInitUseTarball    bool
+	flagInitArchive       string
+	flagInitEditor        string
 )
 
 //go:embed prj-skeleton
 var skeleton embed.FS
 
 func doInit(cmd *cobra.Command, args []string) error {
-	rootdir := mustFindGitRoot()
+	if flagInitEditor != "" {
+		mustBeSupportedEditor(flagInitEditor)
+	}
+
+	// Vendoring a tarball does not require git
+	if flagInitArchive != "" {
+		flagInitUseTarball = true
+	}
+	rootdir := findProjectRoot()
+	if !flagInitUseTarball {
+		rootdir = mustFindGitRoot()
+	}
 
 	// Extract the project skeleton
 	progress("Creating project skeleton...\n")
@@ -50,11 +66,44 @@ func doInit(cmd *cobra.Command, args []string) error {
 	// Create a submodule for libdragon
 	progress("Downloading libdragon...\n")
 
-	if flagInitUseSubmodules {
+	// Save the requested upstream in the project configuration
+	if flagInitRemote != "" || flagInitBranch != "" || flagInitArchive != "" {
+		pcfg := projectConfigForUpdate()
+		if flagInitRemote != "" {
+			pcfg.Libdragon.Remote = flagInitRemote
+		}
+		if flagInitBranch != "" {
+			pcfg.Libdragon.Branch = flagInitBranch
+		}
+		if flagInitArchive != "" {
+			pcfg.Libdragon.Archive = flagInitArchive
+		}
+		saveProjectConfig()
+	}
+
+	cfg := config()
+	if flagInitUseTarball {
+		prefix := "libdragon"
+		if abspwd, err := filepath.Abs("."); err == nil && rootdir != "." {
+			if reldir, err := filepath.Rel(rootdir, abspwd); err == nil {
+				prefix = path.Join(filepath.ToSlash(reldir), prefix)
+			}
+		}
+		vendorTarball(prefix)
+	} else if flagInitUseSubmodules {
 		spawn("git", "submodule", "add", "--force",
 			"--name", LIBDRAGON_SUBMODULE,
-			"--branch", LIBDRAGON_BRANCH,
-			LIBDRAGON_GIT)
+			"--branch", cfg.Libdragon.Branch,
+			cfg.Libdragon.Remote)
+
+		// Find out the repo-relative path where the submodule was added
+		path, err := getOutput("git", "config",
+			"--file", filepath.Join(rootdir, ".gitmodules"),
+			"--get", "submodule."+LIBDRAGON_SUBMODULE+".path")
+		if err != nil {
+			fatal("error reading submodule configuration: %v\n", err)
+		}
+		setLibdragonVendoring(path[0], VENDOR_SUBMODULE)
 	} else {
 		// Reconstruct relative path in repo wrt the current directory, so that
 		// we will be able to tell git subtree where to create the subtree folder.
@@ -75,12 +124,18 @@ func doInit(cmd *cobra.Command, args []string) error {
 		}
 
 		// Add the subtree
-		spawn("git", "-C", rootdir, "subtree", "add", "--prefix", prefix, LIBDRAGON_GIT, LIBDRAGON_BRANCH, "--squash")
+		spawn("git", "-C", rootdir, "subtree", "add", "--prefix", prefix, cfg.Libdragon.Remote, cfg.Libdragon.Branch, "--squash")
+		setLibdragonVendoring(prefix, VENDOR_SUBTREE)
 	}
 
 	progress("Downloading toolchain...\n")
 	updateToolchain()
 
+	if flagInitEditor != "" {
+		progress("Configuring editor...\n")
+		generateEditorConfig(flagInitEditor)
+	}
+
 	return nil
 }
 
@@ -96,5 +151,10 @@ var cmdInit = &cobra.Command{
 func init() {
 	cmdInit.Flags().BoolVarP(&flagInitForce, "force", "f", false, "force overwriting")
 	cmdInit.Flags().BoolVarP(&flagInitUseSubmodules, "submodule", "m", false, "to vendor libdragon, use git submodule instead of git subtree")
+	cmdInit.Flags().StringVarP(&flagInitRemote, "remote", "", "", "git URL of the libdragon repository to vendor (default: "+LIBDRAGON_GIT+")")
+	cmdInit.Flags().StringVarP(&flagInitBranch, "branch", "b", "", "libdragon branch to vendor (default: "+LIBDRAGON_BRANCH+")")
+	cmdInit.Flags().BoolVarP(&flagInitUseTarball, "tarball", "t", false, "to vendor libdragon, extract a source archive instead of using git")
+	cmdInit.Flags().StringVarP(&flagInitArchive, "archive", "", "", "URL or path of the libdragon source archive to vendor (implies --tarball; default: archive of --branch from --remote)")
+	cmdInit.Flags().StringVarP(&flagInitEditor, "editor", "", "", fmt.Sprintf("generate the project configuration for an editor (one of: %v)", editors))
 	rootCmd.AddCommand(cmdInit)
 }
@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// libdragonStamp returns a stamp that identifies the sources of the vendored
+// libdragon. For git vendoring, it is the hash of the git tree of the vendored
+// copy as it is in the working tree, including local changes not yet
+// committed (so it is the vendored tree itself if there are none). The stamp
+// of the last installation is saved in the toolchain, so that changed sources
+// can be detected.
+func libdragonStamp(path, mode string) string {
+	if mode == VENDOR_TARBALL {
+		// The hash of a tarball already covers local changes, as it is
+		// computed on the extracted files.
+		return vendoredHash(path, mode)
+	}
+
+	dir, prefix := findProjectRoot(), filepath.ToSlash(path)+"/"
+	if mode == VENDOR_SUBMODULE {
+		dir, prefix = filepath.Join(dir, path), ""
+	}
+	tree, err := worktreeTree(dir, prefix)
+	if err != nil {
+		vprintf("cannot hash the working tree of %s: %v\n", path, err)
+		return ""
+	}
+	return tree
+}
+
+// worktreeTree returns the hash of the git tree of the specified directory
+// (prefix, relative to the repository in dir, with a trailing slash; empty for
+// the whole repository) with the contents of the working tree, including the
+// changes not yet committed and the untracked files not ignored. The tree is
+// computed in a copy of the index, so that the index of the repository is not
+// modified, and only the files modified since they were last staged need to
+// be hashed.
+func worktreeTree(dir, prefix string) (string, error) {
+	out, err := getOutput("git", "-C", dir, "rev-parse", "--git-path", "index")
+	if err != nil {
+		return "", err
+	}
+	realIndex := strings.TrimSpace(out[0])
+	if !filepath.IsAbs(realIndex) {
+		realIndex = filepath.Join(dir, realIndex)
+	}
+
+	tmpdir, err := os.MkdirTemp("", "libdragon-index")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpdir)
+	index := filepath.Join(tmpdir, "index")
+	if data, err := os.ReadFile(realIndex); err == nil {
+		if err := os.WriteFile(index, data, 0666); err != nil {
+			return "", err
+		}
+	}
+
+	pathspec := prefix
+	if pathspec == "" {
+		pathspec = "."
+	}
+	if _, err := gitWithIndex(index, "-C", dir, "add", "--all", "--", pathspec); err != nil {
+		return "", err
+	}
+	args := []string{"-C", dir, "write-tree"}
+	if prefix != "" {
+		args = append(args, "--prefix="+prefix)
+	}
+	out, err = gitWithIndex(index, args...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out[0]), nil
+}
+
+// gitWithIndex is like getOutput for a git command, but makes git use the
+// specified index file.
+func gitWithIndex(index string, args ...string) ([]string, error) {
+	if flagVerbose {
+		fmt.Println("launching: git", args, "(index: "+index+")")
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+index)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(out), "\n"), nil
+}
+
+// installCacheFile returns the path of the file where the last stamp installed
+// in the toolchain is cached, so that the toolchain does not need to be asked
+// on every build.
+func installCacheFile() string {
+	return filepath.Join(findProjectRoot(), ".git", CACHED_INSTALL_FILE)
+}
+
+// installCacheKey returns the content of the install cache file, for the
+// specified stamp installed in the current toolchain: the container in use
+// (which loses the installation when it is recreated), or the installation
+// directory of a native toolchain.
+func installCacheKey(stamp string) string {
+	toolchain := os.Getenv("N64_INST")
+	if findToolchain().Name() != TOOLCHAIN_NATIVE {
+		toolchain = searchContainer(findProjectRoot(), true)
+	}
+	return toolchain + " " + stamp + "\n"
+}
+
+// libdragonInstalled returns true if the vendored libdragon with the specified
+// stamp is the one installed in the toolchain.
+func libdragonInstalled(stamp string) bool {
+	key := installCacheKey(stamp)
+	if data, err := os.ReadFile(installCacheFile()); err == nil && string(data) == key {
+		return true
+	}
+	err := findToolchain().Exec(execOptions{root: true}, "sh", "-c",
+		`test "$(cat "$N64_INST/`+INSTALL_STAMP_FILE+`" 2>/dev/null)" = "$1"`, "sh", stamp)
+	if err != nil {
+		return false
+	}
+	// Ignore errors, as there is no .git directory outside of git roots.
+	os.WriteFile(installCacheFile(), []byte(key), 0666)
+	return true
+}
+
+// installLibdragon builds the vendored libdragon (and its tools), and installs
+// it in the toolchain, recording the specified stamp. The build runs as the
+// host user, so that the build files in the repository are owned by them,
+// while the installation needs to write into the toolchain.
+func installLibdragon(path, stamp string) error {
+	// Run make from the current directory, which is also the working
+	// directory within the container.
+	dir := filepath.ToSlash(path)
+	if abspwd, err := filepath.Abs("."); err == nil {
+		if root, err := filepath.Abs(findProjectRoot()); err == nil {
+			if rel, err := filepath.Rel(abspwd, filepath.Join(root, path)); err == nil {
+				dir = filepath.ToSlash(rel)
+			}
+		}
+	}
+
+	progress("Building libdragon...\n")
+	if err := findToolchain().Exec(defaultExecOptions(), makeCommand("-C", dir, "all", "tools")...); err != nil {
+		return err
+	}
+
+	progress("Installing libdragon...\n")
+	opts := defaultExecOptions()
+	opts.root = true
+	if err := findToolchain().Exec(opts, "sh", "-c",
+		`make -C "$1" install tools-install && echo "$2" > "$N64_INST/`+INSTALL_STAMP_FILE+`"`,
+		"sh", dir, stamp); err != nil {
+		os.Remove(installCacheFile())
+		return err
+	}
+	os.WriteFile(installCacheFile(), []byte(installCacheKey(stamp)), 0666)
+	return nil
+}
+
+// autoInstallLibdragon builds and installs the vendored libdragon in the
+// toolchain, if its sources changed since it was last installed. It is
+// called before building the project, so that changes to libdragon are
+// picked up without having to install it manually.
+func autoInstallLibdragon() error {
+	path, mode := findLibdragon()
+	if path == "" {
+		return nil
+	}
+	stamp := libdragonStamp(path, mode)
+	if stamp == "" {
+		vprintf("cannot compute the stamp of the vendored libdragon\n")
+		return nil
+	}
+	if libdragonInstalled(stamp) {
+		vprintf("libdragon is up to date: %s\n", stamp)
+		return nil
+	}
+	progress("Vendored libdragon changed since it was last installed\n")
+	return installLibdragon(path, stamp)
+}
+
+func doInstall(cmd *cobra.Command, args []string) error {
+	path, mode := findLibdragon()
+	if path == "" {
+		fatal("cannot find the vendored libdragon (see: libdragon init)\n")
+	}
+	return installLibdragon(path, libdragonStamp(path, mode))
+}
+
+var cmdInstall = &cobra.Command{
+	Use:   "install",
+	Short: "Build and install the vendored libdragon into the toolchain.",
+	Long: `This command builds the vendored copy of libdragon and its tools, and
+installs them into the toolchain, so that they are used to build the project.
+
+This is normally not required, as "libdragon make" automatically does it when
+the vendored sources (including local changes) differ from the ones installed.`,
+	Example: `  libdragon install
+	-- build and install libdragon`,
+	Args:         cobra.NoArgs,
+	RunE:         doInstall,
+	SilenceUsage: true,
+}
+
+func init() {
+	rootCmd.AddCommand(cmdInstall)
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// lockFile records the exact versions of libdragon and of the toolchain
+// that were vendored / pulled by the last update, so that builds can be
+// reproduced and checked with "libdragon verify". It is stored in LOCK_FILE
+// at the project root, and is meant to be committed.
+type lockFile struct {
+	Libdragon *vendorLock            `toml:"libdragon"`
+	Toolchain *toolchainLock         `toml:"toolchain"`
+	Deps      map[string]*vendorLock `toml:"deps,omitempty"`
+}
+
+// vendorLock records the vendored version of a library.
+type vendorLock struct {
+	Remote   string `toml:"remote"`   // upstream git URL (or archive, for tarballs)
+	Commit   string `toml:"commit"`   // upstream commit
+	Vendored string `toml:"vendored"` // hash of the vendored copy (see vendoredHash)
+}
+
+// toolchainLock records the pulled toolchain image.
+type toolchainLock struct {
+	Image  string `toml:"image"`  // image reference
+	Digest string `toml:"digest"` // digest-pinned reference of the pulled image
+}
+
+// lockFilePath returns the path of the lockfile.
+func lockFilePath() string {
+	return filepath.Join(findProjectRoot(), LOCK_FILE)
+}
+
+// readLockFile reads the lockfile. If it does not exist, an empty lockfile is
+// returned.
+func readLockFile() *lockFile {
+	lock := &lockFile{}
+	data, err := os.ReadFile(lockFilePath())
+	if os.IsNotExist(err) {
+		return lock
+	} else if err != nil {
+		fatal("error reading %s: %v\n", LOCK_FILE, err)
+	}
+	if _, err := toml.Decode(string(data), lock); err != nil {
+		fatal("error reading %s: %v\n", LOCK_FILE, err)
+	}
+	return lock
+}
+
+// writeLockFile writes the lockfile.
+func writeLockFile(lock *lockFile) {
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by libdragon update. Do not edit.\n\n")
+	enc := toml.NewEncoder(&buf)
+	enc.Indent = ""
+	if err := enc.Encode(lock); err != nil {
+		fatal("error writing %s: %v\n", LOCK_FILE, err)
+	}
+	if err := os.WriteFile(lockFilePath(), buf.Bytes(), 0666); err != nil {
+		fatal("error writing %s: %v\n", LOCK_FILE, err)
+	}
+}
+
+// vendoredHash returns a hash identifying the content of a vendored library
+// at the specified repo-relative path: for subtrees, the hash of the git tree
+// committed in HEAD; for submodules, the commit checked out in the submodule;
+// for tarballs, the hash of the extracted files (see tarballHash).
+// It returns an empty string if the hash cannot be computed.
+func vendoredHash(path string, mode string) string {
+	var out []string
+	var err error
+	switch mode {
+	case VENDOR_SUBMODULE:
+		out, err = getOutput("git", "-C", filepath.Join(findProjectRoot(), path), "rev-parse", "HEAD")
+	case VENDOR_TARBALL:
+		hash, err := tarballHash(filepath.Join(findProjectRoot(), path))
+		if err != nil {
+			return ""
+		}
+		return hash
+	default:
+		out, err = getOutput("git", "-C", findProjectRoot(), "rev-parse", "HEAD:"+filepath.ToSlash(path))
+	}
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out[0])
+}
+
+// findPinnedDockerImage returns the toolchain image that containers should be
+// created from: the digest-pinned reference recorded in the lockfile, if it was
+// pulled for the image returned by findDockerImage; otherwise, the image itself
+// (eg: if the image was changed after the last update).
+func findPinnedDockerImage() string {
+	image := findDockerImage()
+	if lock := readLockFile(); lock.Toolchain != nil && lock.Toolchain.Image == image && lock.Toolchain.Digest != "" {
+		return lock.Toolchain.Digest
+	}
+	return image
+}
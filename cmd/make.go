@@ -1,25 +1,131 @@
 package cmd
 
 import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
 	"github.com/spf13/cobra"
 )
 
-func doMake(cmd *cobra.Command, args []string) error {
+var (
+	flagMakeCompiledb bool
+)
+
+// hasJobsFlag returns true if the specified make arguments (or words of
+// MAKEFLAGS) select the number of parallel jobs, either with the long option
+// (--jobs) or with the short one (-j), possibly grouped with other short
+// options (eg: -kj4). In MAKEFLAGS, the first word can be a group of short
+// options without a leading dash (eg: "kj").
+func hasJobsFlag(args []string, makeflags bool) bool {
+	for i, arg := range args {
+		if arg == "--jobs" || strings.HasPrefix(arg, "--jobs=") {
+			return true
+		}
+		if strings.HasPrefix(arg, "--jobserver-") {
+			// Run by a parallel make, which already chose the jobs
+			return true
+		}
+		if strings.HasPrefix(arg, "--") {
+			continue
+		}
+		if strings.HasPrefix(arg, "-") {
+			arg = arg[1:]
+		} else if !makeflags || i != 0 || strings.Contains(arg, "=") {
+			continue
+		}
+		// Only look at the option letters: what follows an option
+		// that takes an argument (eg: -C dir, -l4) is not an option.
+		for _, c := range arg {
+			if c == 'j' {
+				return true
+			}
+			if strings.ContainsRune("CIfloW", c) {
+				break
+			}
+		}
+	}
+	return false
+}
+
+// makeCommand returns the command line to run make with the specified
+// arguments. Unless the user already chose the number of parallel jobs (in
+// the arguments or in the MAKEFLAGS that make will see), make runs as many
+// jobs as the configured number, or by default as the CPUs available to the
+// toolchain, limiting the load to the same amount.
+func makeCommand(args ...string) []string {
+	// The environment of the host is not forwarded to the container, so
+	// its MAKEFLAGS only matter for the native toolchain.
+	makeflags, ok := config().Env["MAKEFLAGS"]
+	if !ok && findToolchain().Name() == TOOLCHAIN_NATIVE {
+		makeflags = os.Getenv("MAKEFLAGS")
+	}
+
+	cmdline := append([]string{"make"}, args...)
+	if hasJobsFlag(args, false) || hasJobsFlag(strings.Fields(makeflags), true) {
+		return cmdline
+	}
+
+	jobs := config().Make.Jobs
+	switch {
+	case jobs == 1:
+		return cmdline
+	case jobs > 1:
+		return append([]string{"make", "-j" + strconv.Itoa(jobs)}, args...)
+	case findToolchain().Name() == TOOLCHAIN_NATIVE:
+		n := strconv.Itoa(runtime.NumCPU())
+		return append([]string{"make", "-j" + n, "-l" + n}, args...)
+	}
+
+	// The CPUs available to the container can differ from the ones of the
+	// host (eg: when it runs in a virtual machine), so count them within
+	// the container itself.
+	return append([]string{"sh", "-c", `n=$(nproc); exec make -j"$n" -l"$n" "$@"`, "make"}, args...)
+}
+
+// runMake builds the project, running make with the specified arguments,
+// after installing the vendored libdragon if needed.
+func runMake(args []string) error {
+	if err := autoInstallLibdragon(); err != nil {
+		return err
+	}
+
 	// "libdragon make" is just a shortcut for "libdragon exec make"
-	args = append([]string{"make"}, args...)
-	return spawnDockerExec(args...)
+	return spawnToolchain(makeCommand(args...)...)
+}
+
+func doMake(cmd *cobra.Command, args []string) error {
+	if err := runMake(args); err != nil {
+		return err
+	}
+
+	if flagMakeCompiledb {
+		generateCompiledb(args, defaultCompiledbFile())
+	}
+	return nil
 }
 
 var cmdMake = &cobra.Command{
 	Use:   "make",
 	Short: "Run the libdragon build system.",
+	Long: `This command runs make within the toolchain, to build the current application.
+
+Builds run in parallel, using all the CPUs available to the toolchain, unless
+the number of jobs is specified (with -j, or in MAKEFLAGS: the one set in the
+[env] section of the configuration, or with the native toolchain, the one of
+the environment). The default can be changed with the "jobs" option in the
+[make] section of the configuration.`,
 	Example: `  libdragon make
-	-- build the current application`,
+	-- build the current application
+  libdragon make -- -j1 clean all
+	-- rebuild without running jobs in parallel (note the "--" before make flags)`,
 	RunE:         doMake,
 	SilenceUsage: true,
 }
 
 func init() {
 	cmdMake.Flags().SetInterspersed(false)
+	cmdMake.Flags().BoolVarP(&flagMakeCompiledb, "compiledb", "", false, "after building, update the compilation database (see: libdragon compiledb)")
 	rootCmd.AddCommand(cmdMake)
 }
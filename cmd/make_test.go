@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHasJobsFlag(t *testing.T) {
+	tests := []struct {
+		args      string
+		makeflags bool
+		want      bool
+	}{
+		{"", false, false},
+		{"-j", false, true},
+		{"-j4 all", false, true},
+		{"clean all", false, false},
+		{"-kj4", false, true},
+		{"-k -j4", false, true},
+		{"--jobs", false, true},
+		{"--jobs=2", false, true},
+		{"--jobsx", false, false},
+		{"-l", false, false},
+		{"-l4", false, false},
+		{"-C dir-j", false, false},
+		{"-Cj", false, false},
+		{"-kC j", false, false},
+		{"--directory=j", false, false},
+		{"j4", false, false},
+
+		// MAKEFLAGS: the first word can omit the dash
+		{"ij4", true, true},
+		{"k", true, false},
+		{"k -j2", true, true},
+		{"k ij4", true, false},
+		{"l4", true, false},
+		{"CFLAGS=-j", true, false},
+		{"-- CFLAGS=-j", true, false},
+		{" --jobserver-auth=3,4", true, true},
+		{"ij4", false, false},
+	}
+	for _, tt := range tests {
+		if got := hasJobsFlag(strings.Fields(tt.args), tt.makeflags); got != tt.want {
+			t.Errorf("hasJobsFlag(%q, %v) = %v, want %v", tt.args, tt.makeflags, got, tt.want)
+		}
+	}
+}
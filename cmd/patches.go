@@ -0,0 +1,299 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagPatchesDir string
+)
+
+// localPatchesRange returns the git repository and the revision arguments
+// (as accepted by "git log") that select the local commits made to the
+// library vendored at the specified repo-relative path, that is the commits
+// that are not part of its upstream. It returns false if the vendored
+// upstream commit cannot be found.
+func localPatchesRange(path string, submodule bool) (string, []string, bool) {
+	repoRoot := mustFindGitRoot()
+	if submodule {
+		// Commits in the submodule that are not in the vendored upstream
+		// commit. Updates fetch it from the URL, which does not move the
+		// remote branches, so it must be excluded explicitly.
+		dir := filepath.Join(repoRoot, path)
+		revs := []string{"HEAD", "--not", "--remotes"}
+		if upstream := lockedUpstreamCommit(dir, path); upstream != "" {
+			revs = append(revs, upstream)
+		}
+		return dir, revs, true
+	}
+
+	// Commits that touched the subtree since the last squashed upstream
+	// commit (which is not itself part of the range), ignoring the history
+	// before the subtree was added (eg: if the library was vendored in a
+	// different way before).
+	squash := findSubtreeSquash(path)
+	if squash == "" {
+		return "", nil, false
+	}
+	revs := []string{squash + "..HEAD"}
+	if merge := findSubtreeAddMerge(path); merge != "" {
+		revs = append(revs, "^"+merge+"^1")
+	}
+	return repoRoot, append(revs, "--", filepath.ToSlash(path)), true
+}
+
+// lockedUpstreamCommit returns the upstream commit recorded in the lockfile
+// for the library vendored at the specified repo-relative path, if it is
+// available in the git repository dir. It returns an empty string otherwise.
+func lockedUpstreamCommit(dir string, path string) string {
+	lock := readLockFile()
+	var vl *vendorLock
+	if p, _ := findLibdragon(); filepath.ToSlash(p) == filepath.ToSlash(path) {
+		vl = lock.Libdragon
+	} else {
+		for name, dep := range config().Deps {
+			if filepath.ToSlash(dep.Path) == filepath.ToSlash(path) {
+				vl = lock.Deps[name]
+			}
+		}
+	}
+	if vl == nil || vl.Commit == "" {
+		return ""
+	}
+	if run("git", "-C", dir, "rev-parse", "-q", "--verify", vl.Commit+"^{commit}") != nil {
+		return ""
+	}
+	return vl.Commit
+}
+
+// findSubtreeAddMerge returns the merge commit that added the subtree at the
+// specified repo-relative path (that is, the one that merged the last commit
+// created by "git subtree add --squash"). It returns an empty string if the
+// commit cannot be found.
+func findSubtreeAddMerge(prefix string) string {
+	repoRoot := mustFindGitRoot()
+	out, err := getOutput("git", "-C", repoRoot, "log", "-1", "--all-match", "-E",
+		"--grep", subtreeDirPattern(prefix),
+		"--grep", "^Squashed '.*' content from commit",
+		"--format=tformat:%H")
+	if err != nil || out[0] == "" {
+		return ""
+	}
+	add := out[0]
+
+	merges, err := getOutput("git", "-C", repoRoot, "rev-list", "--merges", "--parents", "HEAD")
+	if err != nil {
+		return ""
+	}
+	for _, line := range merges {
+		fields := strings.Fields(line)
+		for i := 2; i < len(fields); i++ {
+			if fields[i] == add {
+				return fields[0]
+			}
+		}
+	}
+	return ""
+}
+
+// findSubtreeSquash returns the last commit created by "git subtree" with
+// the squashed upstream content of the subtree at the specified repo-relative
+// path. It returns an empty string if the commit cannot be found.
+func findSubtreeSquash(prefix string) string {
+	out, err := getOutput("git", "-C", mustFindGitRoot(), "log", "-1", "-E",
+		"--grep", subtreeDirPattern(prefix),
+		"--format=tformat:%H")
+	if err != nil {
+		return ""
+	}
+	return out[0]
+}
+
+// localVendoredCommits returns the local commits made to the library vendored
+// at the specified repo-relative path, as one-line summaries (oldest first).
+func localVendoredCommits(path string, submodule bool) []string {
+	dir, revs, ok := localPatchesRange(path, submodule)
+	if !ok {
+		return nil
+	}
+	args := append([]string{"-C", dir, "log", "--no-merges", "--reverse", "--format=tformat:%h %s"}, revs...)
+	out, err := getOutput("git", args...)
+	if err != nil {
+		return nil
+	}
+	var commits []string
+	for _, line := range out {
+		if line != "" {
+			commits = append(commits, line)
+		}
+	}
+	return commits
+}
+
+// exportVendoredPatches exports the local commits made to the library vendored
+// at the specified repo-relative path as a patch series in the specified
+// directory, replacing any series previously exported there. Patches are
+// relative to the library root, so that they can also be applied upstream.
+func exportVendoredPatches(path string, submodule bool, outDir string) {
+	dir, revs, ok := localPatchesRange(path, submodule)
+	if !ok {
+		fatal("cannot find the vendored upstream commit of %s\n", path)
+	}
+	outDir, err := filepath.Abs(outDir)
+	if err != nil {
+		fatal("%v\n", err)
+	}
+
+	old, _ := filepath.Glob(filepath.Join(outDir, "[0-9][0-9][0-9][0-9]-*.patch"))
+	for _, f := range old {
+		os.Remove(f)
+	}
+
+	args := []string{"-C", dir, "format-patch", "--output-directory", outDir}
+	if !submodule {
+		args = append(args, "--relative="+filepath.ToSlash(path)+"/")
+	}
+	spawn("git", append(args, revs...)...)
+}
+
+// applyLibdragonPatches applies a patch series (as exported by
+// exportVendoredPatches) to the vendored libdragon copy, creating a commit
+// for each patch.
+func applyLibdragonPatches(path string, submodule bool, files []string) {
+	repoRoot := mustFindGitRoot()
+	args := []string{"-C", repoRoot, "am", "--3way"}
+	if submodule {
+		args[1] = filepath.Join(repoRoot, path)
+	} else {
+		args = append(args, "--directory="+filepath.ToSlash(path))
+	}
+	for _, f := range files {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			fatal("%v\n", err)
+		}
+		args = append(args, abs)
+	}
+	spawn("git", args...)
+}
+
+// patchesDir returns the directory of the patch series managed by the
+// patches command.
+func patchesDir() string {
+	if flagPatchesDir != "" {
+		return flagPatchesDir
+	}
+	return filepath.Join(mustFindGitRoot(), PATCHES_DIR)
+}
+
+// mustFindLibdragon is like findLibdragon, but aborts with fatal if libdragon
+// is not vendored in the repository.
+func mustFindLibdragon() (string, string) {
+	path, mode := findLibdragon()
+	if path == "" {
+		fatal("cannot find libdragon in this repository\n")
+	}
+	return path, mode
+}
+
+// mustFindGitLibdragon is like mustFindLibdragon, for commands that require
+// libdragon to be vendored with git. It returns true if it is vendored as a
+// submodule.
+func mustFindGitLibdragon() (string, bool) {
+	path, mode := mustFindLibdragon()
+	if mode == VENDOR_TARBALL {
+		fatal("this command is not supported when libdragon is vendored as a tarball\n")
+	}
+	return path, mode == VENDOR_SUBMODULE
+}
+
+func doPatchesList(cmd *cobra.Command, args []string) error {
+	commits := localVendoredCommits(mustFindGitLibdragon())
+	if len(commits) == 0 {
+		progress("No local changes to libdragon\n")
+		return nil
+	}
+	for _, c := range commits {
+		fmt.Println(c)
+	}
+	return nil
+}
+
+func doPatchesExport(cmd *cobra.Command, args []string) error {
+	path, submodule := mustFindGitLibdragon()
+	if len(localVendoredCommits(path, submodule)) == 0 {
+		progress("No local changes to libdragon\n")
+		return nil
+	}
+	exportVendoredPatches(path, submodule, patchesDir())
+	return nil
+}
+
+func doPatchesApply(cmd *cobra.Command, args []string) error {
+	path, submodule := mustFindGitLibdragon()
+
+	// Without arguments, apply the series exported in the patches directory
+	files := args
+	if len(files) == 0 {
+		files, _ = filepath.Glob(filepath.Join(patchesDir(), "*.patch"))
+		if len(files) == 0 {
+			fatal("no patches found in %s\n", patchesDir())
+		}
+		sort.Strings(files)
+	}
+	applyLibdragonPatches(path, submodule, files)
+	return nil
+}
+
+var cmdPatches = &cobra.Command{
+	Use:   "patches",
+	Short: "Manage local patches to the vendored libdragon copy.",
+	Long: `This command manages the local changes made to the vendored libdragon copy
+(that is, the commits that touch it and are not part of upstream libdragon).
+They can be listed, exported as a patch series (for instance, to keep them
+safe before an update, or to send them upstream), and applied again.`,
+	Example: `  libdragon patches
+	-- list local commits to libdragon
+  libdragon patches export
+	-- export them as a patch series in the libdragon-patches directory
+  libdragon patches apply
+	-- apply the patch series in the libdragon-patches directory`,
+	Args:         cobra.NoArgs,
+	RunE:         doPatchesList,
+	SilenceUsage: true,
+}
+
+var cmdPatchesList = &cobra.Command{
+	Use:          "list",
+	Short:        "List local commits to the vendored libdragon copy.",
+	Args:         cobra.NoArgs,
+	RunE:         doPatchesList,
+	SilenceUsage: true,
+}
+
+var cmdPatchesExport = &cobra.Command{
+	Use:          "export",
+	Short:        "Export local commits to libdragon as a patch series.",
+	Args:         cobra.NoArgs,
+	RunE:         doPatchesExport,
+	SilenceUsage: true,
+}
+
+var cmdPatchesApply = &cobra.Command{
+	Use:          "apply [patch files]",
+	Short:        "Apply a patch series to the vendored libdragon copy.",
+	RunE:         doPatchesApply,
+	SilenceUsage: true,
+}
+
+func init() {
+	cmdPatches.PersistentFlags().StringVarP(&flagPatchesDir, "dir", "d", "", "directory of the patch series (default: "+PATCHES_DIR+" in the repository root)")
+	cmdPatches.AddCommand(cmdPatchesList, cmdPatchesExport, cmdPatchesApply)
+	rootCmd.AddCommand(cmdPatches)
+}
@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pathMapping maps a directory within the container to the host directory
+// mounted there.
+type pathMapping struct {
+	container string
+	host      string
+}
+
+// containerPathMappings returns the mappings between the directories mounted
+// in the container for the specified root and the host directories, longest
+// container paths first, so that nested mounts take precedence.
+func containerPathMappings(root string) []pathMapping {
+	absroot, err := filepath.Abs(root)
+	if err != nil {
+		absroot = root
+	}
+	mappings := []pathMapping{{VOLUME_ROOT, absroot}}
+	for _, m := range containerMounts(absroot) {
+		mappings = append(mappings, pathMapping{m.Target, m.Source})
+	}
+	sort.SliceStable(mappings, func(i, j int) bool {
+		return len(mappings[i].container) > len(mappings[j].container)
+	})
+	return mappings
+}
+
+// isPathTerminator returns true if c cannot be part of a path as printed by
+// compilers and build tools, so that it marks where a path begins or ends
+// (eg: "/app/foo.c:12:" or "'/app'"). The ESC character is included so that
+// paths can be found right after ANSI escape sequences.
+func isPathTerminator(c byte) bool {
+	return c <= ' ' || strings.IndexByte("'\"`:,;()<>=\x1b", c) >= 0
+}
+
+// pathRewriterHoldTime is how long a pathRewriter holds back a trailing word
+// that might be the beginning of a path, waiting for the rest of it.
+const pathRewriterHoldTime = 100 * time.Millisecond
+
+// pathRewriter is a writer that rewrites container paths to host paths, in the
+// output of commands run in the container, so that they can be opened from
+// the host (eg: by clicking on compiler errors in an editor).
+//
+// The output is processed as it streams, one line at a time. Incomplete lines
+// are written immediately as well (eg: prompts), except for a trailing word
+// that might be the beginning of a path, which is held back until the rest
+// of it arrives, up to pathRewriterHoldTime.
+type pathRewriter struct {
+	w        io.Writer
+	mappings []pathMapping
+	group    *pathRewriterGroup
+	buf      []byte
+	prev     byte // last byte written
+}
+
+// pathRewriterGroup is the state shared by the rewriters of the output streams
+// of the same command, so that they can be written to concurrently, and so
+// that the output held back by one of them is written before any later output
+// of the others, preserving the order of the streams.
+type pathRewriterGroup struct {
+	mu      sync.Mutex
+	members []*pathRewriter
+	timer   *time.Timer
+}
+
+// newPathRewriters creates a pathRewriter for each of the specified writers
+// (eg: stdout and stderr of a command), sharing their state.
+func newPathRewriters(mappings []pathMapping, ws ...io.Writer) []*pathRewriter {
+	group := &pathRewriterGroup{}
+	for _, w := range ws {
+		group.members = append(group.members, &pathRewriter{w: w, mappings: mappings, group: group, prev: '\n'})
+	}
+	return group.members
+}
+
+func (pw *pathRewriter) Write(p []byte) (int, error) {
+	g := pw.group
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// The output held back by the other streams was written before this one
+	for _, other := range g.members {
+		if other != pw {
+			if err := other.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	pw.buf = append(pw.buf, p...)
+
+	// Find the trailing word (after the last terminator), and hold it back
+	// if it might contain a path, or an escape sequence followed by a path.
+	cut := len(pw.buf)
+	for i := len(pw.buf) - 1; i >= 0; i-- {
+		c := pw.buf[i]
+		if c == '/' {
+			cut = i
+		} else if isPathTerminator(c) {
+			if c == '\x1b' || cut != len(pw.buf) {
+				cut = i
+			}
+			break
+		}
+	}
+	if cut == 0 && len(pw.buf) > 4096 {
+		// This is not going to be a path
+		cut = len(pw.buf)
+	}
+
+	if err := pw.emit(pw.buf[:cut]); err != nil {
+		return 0, err
+	}
+	pw.buf = append(pw.buf[:0], pw.buf[cut:]...)
+
+	// Do not hold back the output for too long, in case the rest of it
+	// only arrives after some input (eg: a prompt).
+	if len(pw.buf) > 0 {
+		if g.timer == nil {
+			g.timer = time.AfterFunc(pathRewriterHoldTime, g.flushAll)
+		} else {
+			g.timer.Reset(pathRewriterHoldTime)
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes any output still held back.
+func (pw *pathRewriter) Flush() error {
+	pw.group.mu.Lock()
+	defer pw.group.mu.Unlock()
+	return pw.flush()
+}
+
+func (pw *pathRewriter) flush() error {
+	err := pw.emit(pw.buf)
+	pw.buf = pw.buf[:0]
+	return err
+}
+
+// flushAll writes the output still held back by all the rewriters. It runs
+// on its own, so there is no caller to report errors to.
+func (g *pathRewriterGroup) flushAll() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, pw := range g.members {
+		pw.flush()
+	}
+}
+
+func (pw *pathRewriter) emit(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	out := pw.rewrite(data)
+	pw.prev = data[len(data)-1]
+	_, err := pw.w.Write(out)
+	return err
+}
+
+// startsPath returns true if a path can start at data[i], because it is
+// preceded by a terminator or by an ANSI escape sequence (eg: "\x1b[01m").
+func (pw *pathRewriter) startsPath(data []byte, i int) bool {
+	if i == 0 {
+		return isPathTerminator(pw.prev)
+	}
+	c := data[i-1]
+	if isPathTerminator(c) {
+		return true
+	}
+	if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') {
+		j := i - 2
+		for j >= 0 && (data[j] >= '0' && data[j] <= '9' || data[j] == ';') {
+			j--
+		}
+		return j >= 1 && data[j] == '[' && data[j-1] == '\x1b'
+	}
+	return false
+}
+
+// rewrite returns data with all the container paths replaced by host paths.
+func (pw *pathRewriter) rewrite(data []byte) []byte {
+	if bytes.IndexByte(data, '/') < 0 {
+		return data
+	}
+
+	var out []byte
+	last := 0
+	for i := 0; i < len(data); i++ {
+		if data[i] != '/' || !pw.startsPath(data, i) {
+			continue
+		}
+		for _, m := range pw.mappings {
+			end := i + len(m.container)
+			if !bytes.HasPrefix(data[i:], []byte(m.container)) ||
+				(end < len(data) && data[end] != '/' && !isPathTerminator(data[end])) {
+				continue
+			}
+			for end < len(data) && !isPathTerminator(data[end]) {
+				end++
+			}
+			out = append(out, data[last:i]...)
+			out = append(out, m.host...)
+			out = append(out, filepath.FromSlash(string(data[i+len(m.container):end]))...)
+			last = end
+			i = end - 1
+			break
+		}
+	}
+	if out == nil {
+		return data
+	}
+	return append(out, data[last:]...)
+}
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testMappings = []pathMapping{
+	{"/app/vendor/lib", "/home/me/lib"},
+	{"/app", "/home/me/game"},
+}
+
+// lockedBuffer is a bytes.Buffer that can be written by the rewriter timers.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// rewriteChunks writes the chunks to a pathRewriter, and returns its output.
+func rewriteChunks(chunks ...string) string {
+	var out lockedBuffer
+	pw := newPathRewriters(testMappings, &out)[0]
+	for _, c := range chunks {
+		pw.Write([]byte(c))
+	}
+	pw.Flush()
+	return out.String()
+}
+
+func TestPathRewriter(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"/app/src/main.c:12:3: error\n", "/home/me/game/src/main.c:12:3: error\n"},
+		{"/app\n", "/home/me/game\n"},
+		{"cd '/app/build'\n", "cd '/home/me/game/build'\n"},
+		{"-I/app/include\n", "-I/app/include\n"},
+		{"-I /app/include\n", "-I /home/me/game/include\n"},
+		{"/application/x\n", "/application/x\n"},
+		{"/opt/app/x\n", "/opt/app/x\n"},
+		{"/app/vendor/lib/a.c:1: warning\n", "/home/me/lib/a.c:1: warning\n"},
+		{"/app/vendor/library.c\n", "/home/me/game/vendor/library.c\n"},
+		{"\x1b[01m\x1b[K/app/a.c:1:\x1b[m\n", "\x1b[01m\x1b[K/home/me/game/a.c:1:\x1b[m\n"},
+		{"make: Leaving directory '/app'\n", "make: Leaving directory '/home/me/game'\n"},
+		{"no paths here\n", "no paths here\n"},
+	}
+	for _, tt := range tests {
+		if got := rewriteChunks(tt.in); got != tt.want {
+			t.Errorf("rewrite(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPathRewriterSplitWrites(t *testing.T) {
+	tests := [][]string{
+		{"/ap", "p/src/main.c:1: error\n"},
+		{"/app", "/src/main.c:1: error\n"},
+		{"/app/", "src/main.c:1: error\n"},
+		{"/app/src/ma", "in.c:1: error\n"},
+		{"/", "a", "p", "p", "/src/main.c:1: error\n"},
+		{"/app/src/main.c", ":1: error\n"},
+	}
+	want := "/home/me/game/src/main.c:1: error\n"
+	for _, chunks := range tests {
+		if got := rewriteChunks(chunks...); got != want {
+			t.Errorf("rewrite(%q) = %q, want %q", chunks, got, want)
+		}
+	}
+
+	// A path cannot start right after the end of the previous chunk, if
+	// it was not a terminator.
+	if got, want := rewriteChunks("x", "/app/a.c\n"), "x/app/a.c\n"; got != want {
+		t.Errorf("rewrite split after a word = %q, want %q", got, want)
+	}
+	if got, want := rewriteChunks("x ", "/app/a.c\n"), "x /home/me/game/a.c\n"; got != want {
+		t.Errorf("rewrite split after a space = %q, want %q", got, want)
+	}
+	if got, want := rewriteChunks("\x1b[01m", "/app/a.c\n"), "\x1b[01m/home/me/game/a.c\n"; got != want {
+		t.Errorf("rewrite split after an escape sequence = %q, want %q", got, want)
+	}
+}
+
+func TestPathRewriterHoldsOnlyPaths(t *testing.T) {
+	var out lockedBuffer
+	pw := newPathRewriters(testMappings, &out)[0]
+
+	// Incomplete lines are written right away, except for what might be
+	// the beginning of a path.
+	pw.Write([]byte("Continue? [y/n] "))
+	if got, want := out.String(), "Continue? [y/n] "; got != want {
+		t.Errorf("prompt written as %q, want %q", got, want)
+	}
+	pw.Write([]byte("compiling /ap"))
+	if got, want := out.String(), "Continue? [y/n] compiling"; got != want {
+		t.Errorf("partial path written as %q, want %q", got, want)
+	}
+	pw.Flush()
+	if got, want := out.String(), "Continue? [y/n] compiling /ap"; got != want {
+		t.Errorf("flushed output = %q, want %q", got, want)
+	}
+}
+
+func TestPathRewriterTimeout(t *testing.T) {
+	var out lockedBuffer
+	pw := newPathRewriters(testMappings, &out)[0]
+	pw.Write([]byte("Save to /app"))
+	if got, want := out.String(), "Save to"; got != want {
+		t.Errorf("output before the timeout = %q, want %q", got, want)
+	}
+	time.Sleep(3 * pathRewriterHoldTime)
+	if got, want := out.String(), "Save to /home/me/game"; got != want {
+		t.Errorf("output after the timeout = %q, want %q", got, want)
+	}
+}
+
+func TestPathRewriterOrdering(t *testing.T) {
+	var out lockedBuffer
+	rw := newPathRewriters(testMappings, &out, &out)
+	stdout, stderr := rw[0], rw[1]
+
+	stdout.Write([]byte("CC /app/a"))
+	stderr.Write([]byte("/app/a.c:1: error\n"))
+	stdout.Write([]byte(".o\n"))
+	stdout.Flush()
+	stderr.Flush()
+
+	// The beginning of the path held back by stdout is written before the
+	// output of stderr, rewritten as far as it arrived.
+	want := "CC /home/me/game/a/home/me/game/a.c:1: error\n.o\n"
+	if got := out.String(); got != want {
+		t.Errorf("interleaved output = %q, want %q", got, want)
+	}
+}
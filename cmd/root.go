@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"strings"
 
@@ -12,28 +14,53 @@ var (
 	DOCKER_IMAGE          = "anacierdem/libdragon"
 	CACHED_CONTAINER_FILE = "libdragon-docker-container"
 	CACHED_IMAGE_FILE     = ".libdragon-docker-image"
+	CACHED_INSTALL_FILE   = "libdragon-install-stamp"
 	VOLUME_ROOT           = "/app"
 	LIBDRAGON_GIT         = "https://github.com/DragonMinded/libdragon"
 	LIBDRAGON_BRANCH      = "trunk"
 	LIBDRAGON_SUBMODULE   = "libdragon"
+	CONTAINER_HOME        = "/tmp/libdragon-home"
+	CONTAINER_LABEL       = "libdragon.root"
+	CONTAINER_USER_LABEL  = "libdragon.user"
+	CONTAINER_IMAGE_LABEL = "libdragon.image"
+	CONFIG_FILE           = "libdragon.toml"
+	LOCK_FILE             = "libdragon.lock"
+	PATCHES_DIR           = "libdragon-patches"
+	USER_CONFIG_FILE      = "config.toml"
+	RUNTIME_ENV           = "LIBDRAGON_RUNTIME"
+	TOOLCHAIN_ENV         = "LIBDRAGON_TOOLCHAIN"
+	TOOLCHAIN_CONTAINER   = "container"
+	TOOLCHAIN_NATIVE      = "native"
+	VENDOR_SUBTREE        = "subtree"
+	VENDOR_SUBMODULE      = "submodule"
+	VENDOR_TARBALL        = "tarball"
+	LOCAL_PATCH_FILE      = "libdragon-local.patch"
+	TARBALL_MANIFEST      = ".libdragon-tarball"
+	INSTALL_STAMP_FILE    = ".libdragon-install-stamp"
 )
 
 var (
-	flagVerbose  bool
-	flagChdir    string
-	flagColorize bool
+	flagVerbose     bool
+	flagChdir       string
+	flagColorize    bool
+	flagNoHostPaths bool
 )
 
 var rootCmd = &cobra.Command{
 	Use:   "libdragon",
 	Short: "libdragon command line tool",
 	Long:  "libdragon tool - help managing development of Nintendo 64 ROMs using libdragon",
+
+	// Errors are printed by Execute, so that exit codes of commands run
+	// in the toolchain can be forwarded silently.
+	SilenceErrors: true,
 }
 
 func Execute() {
 	rootCmd.PersistentFlags().BoolVarP(&flagVerbose, "verbose", "v", false, "be verbose")
 	rootCmd.PersistentFlags().StringVarP(&flagChdir, "chdir", "C", "", "work in the specified directory")
 	rootCmd.PersistentFlags().BoolVarP(&flagColorize, "color", "", true, "use colorful output")
+	rootCmd.PersistentFlags().BoolVarP(&flagNoHostPaths, "no-host-paths", "", false, "do not rewrite container paths to host paths in the output of the toolchain")
 
 	cobra.OnInitialize(func() {
 		if flagChdir != "" {
@@ -61,6 +88,13 @@ func Execute() {
 	rootCmd.SetUsageTemplate(usageTemplate)
 
 	if err := rootCmd.Execute(); err != nil {
+		// Commands running a process in the toolchain forward its exit code
+		// as-is, without adding noise to its output.
+		var ee *exitCodeError
+		if errors.As(err, &ee) {
+			os.Exit(ee.code)
+		}
+		fmt.Fprintln(os.Stderr, "Error:", err.Error())
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagRunEmulator string
+	flagRunNoBuild  bool
+)
+
+// findROM looks for the ROM of the current project, in the same places where
+// disasm looks for the ELF file (see findBuildOutput). It returns the path of
+// the ROM and the directory where make should be run to build it, or empty
+// strings if none is found.
+func findROM() (string, string) {
+	matches, dir := findBuildOutput("*.z64")
+	if len(matches) > 1 {
+		fatal("multiple ROM files found in %s -- specify the one to run\n", dir)
+	}
+	if len(matches) == 0 {
+		return "", ""
+	}
+	return matches[0], dir
+}
+
+// findMakefileDir returns the directory where make should be run to build the
+// current project, when no ROM was built yet: the nearest directory with a
+// Makefile, from the current directory up to the project root, or otherwise
+// the project root itself.
+func findMakefileDir() string {
+	root := findProjectRoot()
+	dir := "."
+	for {
+		if isFile(filepath.Join(dir, "Makefile")) {
+			return dir
+		}
+		abs, err := filepath.Abs(dir)
+		if err != nil || abs == root || filepath.Dir(abs) == abs {
+			break
+		}
+		dir = filepath.Join(dir, "..")
+	}
+	return root
+}
+
+// emulatorCommand returns the command line to run the ROM in the emulator,
+// from the specified template: "{rom}" is replaced with the path of the ROM,
+// which is otherwise appended to the command line.
+func emulatorCommand(template string, rom string) []string {
+	if runtime.GOOS == "windows" {
+		// Backslashes are path separators on Windows, not escapes.
+		template = strings.ReplaceAll(template, `\`, `\\`)
+	}
+	args := splitShellWords(template)
+	found := false
+	for i, arg := range args {
+		if strings.Contains(arg, "{rom}") {
+			args[i] = strings.ReplaceAll(arg, "{rom}", rom)
+			found = true
+		}
+	}
+	if !found {
+		args = append(args, rom)
+	}
+	return args
+}
+
+// buildIn runs make in the specified directory.
+func buildIn(dir string) error {
+	if dir != "." {
+		if err := os.Chdir(dir); err != nil {
+			fatal("%v\n", err)
+		}
+		vprintf("chdir to: %s\n", dir)
+	}
+	return runMake(nil)
+}
+
+func doRun(cmd *cobra.Command, args []string) error {
+	template := flagRunEmulator
+	if template == "" {
+		template = config().Run.Emulator
+	}
+	if strings.TrimSpace(template) == "" {
+		critical("error: no emulator configured\n")
+		fatal("Set the emulator command line in the [run] section of the configuration (eg: emulator = \"ares {rom}\"), or use --emulator\n")
+	}
+
+	var rom, dir string
+	if len(args) > 0 {
+		rom = args[0]
+	} else {
+		rom, dir = findROM()
+	}
+
+	// Always build: make knows best whether the ROM is up to date.
+	if !flagRunNoBuild {
+		progress("Building...\n")
+		if rom != "" {
+			rom, _ = filepath.Abs(rom)
+		}
+		if dir == "" {
+			dir = findMakefileDir()
+		}
+		if err := buildIn(dir); err != nil {
+			return err
+		}
+		if rom == "" {
+			rom, _ = findROM()
+		}
+	}
+	if rom == "" {
+		fatal("cannot find ROM file to run -- specify the one to run\n")
+	}
+	rom, _ = filepath.Abs(rom)
+
+	emulator := emulatorCommand(template, rom)
+	progress("Running %s\n", strings.Join(emulator, " "))
+	code, err := spawnExitCode(emulator[0], emulator[1:]...)
+	if err != nil {
+		fatal_exitproc(err, emulator[0], emulator[1:])
+	}
+	if code != 0 {
+		return &exitCodeError{code}
+	}
+	return nil
+}
+
+var cmdRun = &cobra.Command{
+	Use:   "run [rom]",
+	Short: "Run the ROM of the current project in an emulator.",
+	Long: `This command runs the ROM of the current project in an emulator. The ROM is
+searched like "libdragon disasm" searches the ELF file, unless specified. The
+project is built first with "libdragon make" (unless --no-build is given), in
+the directory of the ROM or, if it was not built yet, in the nearest directory
+with a Makefile.
+
+The emulator command line is configured with the "emulator" option in the
+[run] section of the configuration, where {rom} is replaced with the path of
+the ROM. As emulators are installed in different places on each machine, this
+is usually set in the user configuration.`,
+	Example: `  libdragon run
+	-- build and run the ROM of the current project
+  libdragon run --emulator "ares --fullscreen {rom}" build/game.z64
+	-- run a specific ROM with a specific emulator command line`,
+	Args:         cobra.MaximumNArgs(1),
+	RunE:         doRun,
+	SilenceUsage: true,
+}
+
+func init() {
+	cmdRun.Flags().StringVarP(&flagRunEmulator, "emulator", "e", "", "emulator command line, with {rom} replaced by the ROM path (default: from the configuration)")
+	cmdRun.Flags().BoolVarP(&flagRunNoBuild, "no-build", "", false, "do not build the project before running the ROM")
+	rootCmd.AddCommand(cmdRun)
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// containerInfo holds the state of an existing container, as reported by
+// containerRuntime.InspectContainer.
+type containerInfo struct {
+	Image    string // ID of the image the container was created from, if known
+	ImageRef string // Reference of the image the container was created from
+	Running  bool   // True if the container is running
+	User     string // User the container was created for (see containerUser), if known
+}
+
+// containerSpec describes a container to create.
+type containerSpec struct {
+	Path   string        // host path to mount as VOLUME_ROOT
+	Image  string        // toolchain image
+	User   string        // if not empty, run processes as this user ("uid:gid")
+	Mounts []mountConfig // additional mounts (with absolute host paths)
+}
+
+// containerRuntime abstracts the container engine used to run the toolchain.
+// All engines are driven through their command line client.
+type containerRuntime interface {
+	// Name returns the name of the runtime, which is also the name of its
+	// command line client.
+	Name() string
+
+	// FindContainer returns the ID of the container previously created for
+	// the specified path, or an empty string if there is none.
+	FindContainer(path string) (string, error)
+
+	// InspectContainer returns the state of the specified container. It
+	// fails if the container does not exist (or the engine is unreachable).
+	InspectContainer(container string) (containerInfo, error)
+
+	// UsesImage returns true if a container (as returned by InspectContainer)
+	// was created from the specified image.
+	UsesImage(info containerInfo, image string) bool
+
+	// CreateContainer creates and starts a new container, and returns its ID.
+	CreateContainer(spec containerSpec) (string, error)
+
+	// StartContainer starts an existing container.
+	StartContainer(container string) error
+
+	// RemoveContainer stops and removes an existing container.
+	RemoveContainer(container string) error
+
+	// Pull downloads an image, showing progress to the user.
+	Pull(image string) error
+
+	// ImageDigest returns the repository digest of a local image, as a
+	// digest-pinned reference (eg: "user/image@sha256:...").
+	ImageDigest(image string) (string, error)
+
+	// ExecArgs returns the command line (including the client name) to run
+	// the specified command within a container, with the specified working
+	// directory, environment variables ("VAR=value") and user.
+	ExecArgs(container string, opts execOptions, workdir string, env []string, user string, args []string) []string
+}
+
+// runtimes is the list of supported runtimes, in order of preference for
+// autodetection.
+var runtimes = []containerRuntime{
+	&dockerRuntime{command: "docker"},
+	&podmanRuntime{dockerRuntime{command: "podman"}},
+	&nerdctlRuntime{dockerRuntime{command: "nerdctl"}},
+}
+
+var cachedRuntime containerRuntime
+
+// findRuntime returns the container runtime selected by the user or, if none
+// was selected, the first one that is installed. The selection can be done via
+// the LIBDRAGON_RUNTIME environment variable or the "toolchain.runtime"
+// configuration option (in this order). It returns nil if no runtime is available.
+func findRuntime() containerRuntime {
+	if cachedRuntime != nil {
+		return cachedRuntime
+	}
+
+	name := os.Getenv(RUNTIME_ENV)
+	if name == "" {
+		name = config().Toolchain.Runtime
+	}
+	if name != "" {
+		for _, rt := range runtimes {
+			if rt.Name() == name {
+				cachedRuntime = rt
+				return rt
+			}
+		}
+		fatal("unsupported container runtime: %s\n", name)
+	}
+
+	for _, rt := range runtimes {
+		if _, err := exec.LookPath(rt.Name()); err == nil {
+			vprintf("container runtime: %s\n", rt.Name())
+			cachedRuntime = rt
+			return rt
+		}
+	}
+	return nil
+}
+
+// mustFindRuntime is like findRuntime, but aborts with fatal if no container
+// runtime is available.
+func mustFindRuntime() containerRuntime {
+	rt := findRuntime()
+	if rt == nil {
+		critical("error: this command requires a container runtime\n")
+		fatal("Please install Docker from: https://docs.docker.com/get-docker/\n")
+	}
+	return rt
+}
+
+// splitImageRef splits an image reference into its fully-qualified repository
+// name (eg: "anacierdem/libdragon" => "docker.io/anacierdem/libdragon") and its
+// tag or digest (eg: ":latest" or "@sha256:..."), which defaults to ":latest".
+func splitImageRef(ref string) (string, string) {
+	name, suffix := ref, ""
+	if idx := strings.Index(name, "@"); idx >= 0 {
+		name, suffix = name[:idx], name[idx:]
+	} else if idx := strings.LastIndex(name, ":"); idx > strings.LastIndex(name, "/") {
+		name, suffix = name[:idx], name[idx:]
+	} else {
+		suffix = ":latest"
+	}
+
+	// A registry is present if the first component looks like a hostname.
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 1 || !strings.ContainsAny(parts[0], ".:") && parts[0] != "localhost" {
+		if len(parts) == 1 {
+			name = "library/" + name
+		}
+		name = "docker.io/" + name
+	}
+	return name, suffix
+}
+
+// normalizeImageRef converts an image reference to its fully-qualified form
+// (eg: "anacierdem/libdragon" => "docker.io/anacierdem/libdragon:latest"), so
+// that references can be compared.
+func normalizeImageRef(ref string) string {
+	name, suffix := splitImageRef(ref)
+	return name + suffix
+}
@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dockerRuntime implements containerRuntime for Docker. It is also the base
+// for other runtimes with a Docker-compatible command line client.
+type dockerRuntime struct {
+	command string
+}
+
+func (r *dockerRuntime) Name() string {
+	return r.command
+}
+
+// findByLabel searches for a container created by libdragon for the specified
+// path, using the label attached to it by CreateContainer.
+func (r *dockerRuntime) findByLabel(path string) (string, error) {
+	out, err := getOutput(r.command, "container", "ls", "-qa", "-f", "label="+CONTAINER_LABEL+"="+path)
+	if err != nil {
+		return "", err
+	}
+	return out[0], nil
+}
+
+func (r *dockerRuntime) FindContainer(path string) (string, error) {
+	if id, err := r.findByLabel(path); id != "" || err != nil {
+		return id, err
+	}
+
+	// Containers created by older versions have no label: look for
+	// containers that mount the same volume.
+	out, err := getOutput(r.command, "container", "ls", "-qa", "-f", "volume="+path)
+	if err != nil {
+		return "", err
+	}
+	return out[0], nil
+}
+
+func (r *dockerRuntime) InspectContainer(container string) (containerInfo, error) {
+	return r.inspect(container, "{{.Image}} {{.State.Running}} {{.Config.Image}}")
+}
+
+// inspect runs "container inspect" with a template that must output the image
+// ID, the running state and the image reference, separated by spaces. The
+// user label (see runArgs) is appended to them; it is missing in containers
+// created by older versions.
+func (r *dockerRuntime) inspect(container string, format string) (containerInfo, error) {
+	format += ` {{index .Config.Labels "` + CONTAINER_USER_LABEL + `"}}`
+	out, err := getOutput(r.command, "container", "inspect", "-f", format, container)
+	if err != nil {
+		return containerInfo{}, err
+	}
+	fields := strings.Fields(out[0])
+	if len(fields) != 3 && len(fields) != 4 {
+		return containerInfo{}, fmt.Errorf("unexpected inspect output: %q", out[0])
+	}
+	info := containerInfo{
+		Image:    fields[0],
+		Running:  fields[1] == "true",
+		ImageRef: fields[2],
+	}
+	if len(fields) == 4 && fields[3] != "<no value>" {
+		info.User = fields[3]
+	}
+	return info, nil
+}
+
+func (r *dockerRuntime) UsesImage(info containerInfo, image string) bool {
+	// Compare the image IDs if the toolchain image is available locally.
+	// Otherwise, the container can only be using it if the image was removed
+	// after the container was created, so compare the references instead.
+	if id, err := r.imageID(image); err == nil {
+		return id == info.Image
+	}
+	return normalizeImageRef(info.ImageRef) == normalizeImageRef(image)
+}
+
+// imageID returns the ID of the specified image, which must be available
+// locally.
+func (r *dockerRuntime) imageID(image string) (string, error) {
+	out, err := getOutput(r.command, "image", "inspect", "-f", "{{.Id}}", image)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out[0]), nil
+}
+
+// runArgs returns the common arguments to create the specified container.
+// Runtime-specific arguments can be appended to them, before appending the
+// image and command with containerCommand. The container is labeled with the
+// path and with the requested user, so that it can be recreated if the user
+// changes (the user options depend on the runtime).
+func (r *dockerRuntime) runArgs(spec containerSpec) []string {
+	return []string{"run",
+		"-e", "IS_DOCKER=true",
+		"-d", // detached
+		"--label", CONTAINER_LABEL + "=" + spec.Path,
+		"--label", CONTAINER_USER_LABEL + "=" + containerUser(spec.User),
+		"-w", VOLUME_ROOT, // working dir
+	}
+}
+
+// containerCommand returns the image and command to run as main process of
+// the container. It creates the home directory (which might not exist when
+// running as the host user) and then idles forever.
+func containerCommand(image string) []string {
+	return []string{
+		image,
+		"sh", "-c", `mkdir -p "$HOME"; exec tail -f /dev/null`,
+	}
+}
+
+// userArgs returns the arguments to run a container process as the specified
+// host user, with a writable home directory.
+func userArgs(user string) []string {
+	if user == "" {
+		return nil
+	}
+	return []string{"--user", user, "-e", "HOME=" + CONTAINER_HOME}
+}
+
+// mountArgs returns the arguments to bind mount the project and the additional
+// mounts in the container. opts is appended to the options of each mount.
+func mountArgs(spec containerSpec, opts string) []string {
+	args := []string{"--mount", "type=bind,source=" + spec.Path + ",target=" + VOLUME_ROOT + opts}
+	for _, m := range spec.Mounts {
+		mount := "type=bind,source=" + m.Source + ",target=" + m.Target + opts
+		if m.ReadOnly {
+			mount += ",readonly"
+		}
+		args = append(args, "--mount", mount)
+	}
+	return args
+}
+
+func (r *dockerRuntime) CreateContainer(spec containerSpec) (string, error) {
+	args := r.runArgs(spec)
+	args = append(args, mountArgs(spec, "")...)
+	args = append(args, userArgs(spec.User)...)
+	args = append(args, containerCommand(spec.Image)...)
+	return r.create(args)
+}
+
+// create runs the specified "run" command line and returns the container ID.
+func (r *dockerRuntime) create(args []string) (string, error) {
+	out, err := getOutput(r.command, args...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out[0]), nil
+}
+
+func (r *dockerRuntime) StartContainer(container string) error {
+	return run(r.command, "container", "start", container)
+}
+
+func (r *dockerRuntime) RemoveContainer(container string) error {
+	return run(r.command, "container", "rm", "--force", container)
+}
+
+func (r *dockerRuntime) Pull(image string) error {
+	code, err := spawnExitCode(r.command, "pull", image)
+	if err == nil && code != 0 {
+		err = &exitCodeError{code}
+	}
+	return err
+}
+
+func (r *dockerRuntime) ImageDigest(image string) (string, error) {
+	out, err := getOutput(r.command, "image", "inspect", "-f", "{{range .RepoDigests}}{{println .}}{{end}}", image)
+	if err != nil {
+		return "", err
+	}
+	return matchRepoDigest(image, out)
+}
+
+// matchRepoDigest selects, among the repository digests of an image, the one
+// for the repository of the specified reference. An image can have multiple
+// digests if it was pulled from multiple repositories.
+func matchRepoDigest(image string, digests []string) (string, error) {
+	repo, _ := splitImageRef(image)
+	for _, d := range digests {
+		d = strings.TrimSpace(d)
+		if r, suffix := splitImageRef(d); r == repo && strings.HasPrefix(suffix, "@") {
+			return d, nil
+		}
+	}
+	return "", fmt.Errorf("no repository digest found (was the image pulled from a registry?)")
+}
+
+func (r *dockerRuntime) ExecArgs(container string, opts execOptions, workdir string, env []string, user string, args []string) []string {
+	cmd := []string{r.command, "exec", "--workdir", workdir}
+	for _, e := range env {
+		cmd = append(cmd, "--env", e)
+	}
+	if user != "" {
+		// Containers are normally started with the host user already, but
+		// be explicit in case it was started by an older version.
+		cmd = append(cmd, "--user", user, "--env", "HOME="+CONTAINER_HOME)
+	}
+	if opts.interactive {
+		cmd = append(cmd, "--interactive")
+	}
+	if opts.tty {
+		cmd = append(cmd, "--tty")
+	}
+	cmd = append(cmd, container)
+	return append(cmd, args...)
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"os"
+)
+
+// nerdctlRuntime implements containerRuntime for nerdctl (containerd). Its
+// command line is Docker-compatible, but containers do not expose the ID of
+// their image (so it is recorded in a label when they are created), and there
+// is no volume filter.
+type nerdctlRuntime struct {
+	dockerRuntime
+}
+
+// rootless returns true if nerdctl is running in rootless mode, which is
+// always the case when it is not run by root.
+func (r *nerdctlRuntime) rootless() bool {
+	return os.Getuid() != 0
+}
+
+func (r *nerdctlRuntime) FindContainer(path string) (string, error) {
+	return r.findByLabel(path)
+}
+
+func (r *nerdctlRuntime) InspectContainer(container string) (containerInfo, error) {
+	// nerdctl reports the image reference in place of the image ID: read
+	// the ID from the label instead ("-" if the container has none).
+	info, err := r.inspect(container, `{{with index .Config.Labels "`+CONTAINER_IMAGE_LABEL+`"}}{{.}}{{else}}-{{end}} {{.State.Running}} {{.Image}}`)
+	if info.Image == "-" {
+		info.Image = ""
+	}
+	return info, err
+}
+
+func (r *nerdctlRuntime) UsesImage(info containerInfo, image string) bool {
+	if info.Image == "" {
+		return normalizeImageRef(info.ImageRef) == normalizeImageRef(image)
+	}
+	return r.dockerRuntime.UsesImage(info, image)
+}
+
+func (r *nerdctlRuntime) CreateContainer(spec containerSpec) (string, error) {
+	args := r.runArgs(spec)
+	if id, err := r.imageID(spec.Image); err == nil {
+		args = append(args, "--label", CONTAINER_IMAGE_LABEL+"="+id)
+	}
+	args = append(args, mountArgs(spec, "")...)
+
+	// In rootless mode, the container root is mapped to the host user, so
+	// files are already created with the correct owner.
+	if !r.rootless() {
+		args = append(args, userArgs(spec.User)...)
+	}
+
+	args = append(args, containerCommand(spec.Image)...)
+	return r.create(args)
+}
+
+func (r *nerdctlRuntime) ExecArgs(container string, opts execOptions, workdir string, env []string, user string, args []string) []string {
+	if r.rootless() {
+		user = ""
+	}
+	return r.dockerRuntime.ExecArgs(container, opts, workdir, env, user, args)
+}
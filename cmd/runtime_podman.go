@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"os"
+)
+
+// podmanRuntime implements containerRuntime for Podman. Its command line is
+// Docker-compatible, but there are a few differences, mainly related to
+// rootless mode which is the default for Podman.
+type podmanRuntime struct {
+	dockerRuntime
+}
+
+// rootless returns true if Podman is running in rootless mode, which is
+// always the case when it is not run by root.
+func (r *podmanRuntime) rootless() bool {
+	return os.Getuid() != 0
+}
+
+func (r *podmanRuntime) FindContainer(path string) (string, error) {
+	// Podman volume filter does not match bind mounts, so only labels can
+	// be used.
+	return r.findByLabel(path)
+}
+
+func (r *podmanRuntime) CreateContainer(spec containerSpec) (string, error) {
+	args := r.runArgs(spec)
+
+	// Relabel the mounts for SELinux, as otherwise the container would not be
+	// able to access them on SELinux-enabled distributions (eg: Fedora).
+	args = append(args, mountArgs(spec, ",relabel=shared")...)
+
+	if spec.User != "" && r.rootless() {
+		// In rootless mode, the container root is mapped to the host user
+		// by default, and "--user" would map to a subordinate ID instead.
+		// Ask Podman to keep the host user ID within the container.
+		args = append(args, "--userns=keep-id", "-e", "HOME="+CONTAINER_HOME)
+	} else {
+		args = append(args, userArgs(spec.User)...)
+	}
+
+	args = append(args, containerCommand(spec.Image)...)
+	return r.create(args)
+}
+
+func (r *podmanRuntime) ExecArgs(container string, opts execOptions, workdir string, env []string, user string, args []string) []string {
+	// In rootless mode, the container was created to run as the host user
+	// already (see CreateContainer). Commands that need root privileges
+	// (eg: to install into the toolchain) still run as the container root.
+	if user != "" && user == hostUser() && r.rootless() {
+		user = ""
+		env = append(env, "HOME="+CONTAINER_HOME)
+	}
+	return r.dockerRuntime.ExecArgs(container, opts, workdir, env, user, args)
+}
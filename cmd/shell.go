@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func doShell(cmd *cobra.Command, args []string) error {
+	// Always forward stdin, even if it is not a terminal, so that commands
+	// can also be piped into the shell.
+	opts := defaultExecOptions()
+	opts.interactive = true
+	// Interactive programs redraw the terminal in ways that cannot be
+	// rewritten line by line.
+	opts.hostPaths = false
+	tc := findToolchain()
+	return tc.Exec(opts, tc.ShellCommand()...)
+}
+
+var cmdShell = &cobra.Command{
+	Use:   "shell",
+	Short: "Open an interactive shell within the libdragon toolchain.",
+	Example: `  libdragon shell
+	-- open a shell in the container, in the current directory`,
+	Args:         cobra.NoArgs,
+	RunE:         doShell,
+	SilenceUsage: true,
+}
+
+func init() {
+	rootCmd.AddCommand(cmdShell)
+}
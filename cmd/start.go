@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -8,77 +9,229 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// hostUser returns the user (in "uid:gid" format) that should be used to run
+// processes within the container, so that files created in the mounted
+// volume are owned by the host user. It returns an empty string if processes
+// should run as root, which is the case on Windows (where there are no
+// Unix-like file permissions), or if the user disabled this feature via the
+// "toolchain.host_user" configuration option.
+func hostUser() string {
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid <= 0 || gid < 0 {
+		return ""
+	}
+	if hu := config().Toolchain.HostUser; hu != nil && !*hu {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", uid, gid)
+}
+
+// lookupContainer searches for the libdragon container associated to a
+// certain path, without starting it. It returns an empty string if there is
+// none, and an error if the runtime cannot be reached (eg: the daemon is not
+// running).
+func lookupContainer(rt containerRuntime, path string) (string, error) {
+	if container := readContainerFile(path); container != "" {
+		if _, err := rt.InspectContainer(container); err == nil {
+			vprintf("container found: %v\n", container)
+			return container, nil
+		}
+	}
+
+	container, err := rt.FindContainer(path)
+	if container != "" {
+		vprintf("container found: %v\n", container)
+	}
+	return container, err
+}
+
+// readContainerFile returns the container ID recorded in the container file
+// of the specified path. This is the fastest and safest way to find the
+// container associated with this directory, but only works for directories
+// which are git roots.
+// Otherwise, if we are requested to mount in a directory which is not a repo
+// root, there will be no container file to speed up further usage later.
+func readContainerFile(path string) string {
+	containerBytes, err := os.ReadFile(filepath.Join(path, ".git", CACHED_CONTAINER_FILE))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(containerBytes))
+}
+
+// startedContainers caches the containers started by autostartContainer, so
+// that commands running multiple processes in the container check it once.
+var startedContainers = make(map[string]string)
+
 // searchContainer searches for a libdragon container associated to a certain
 // path, and optionally autostarts it if not found. Returns the container ID.
+// When autostart is requested, the container is also checked to be running
+// the toolchain image that findPinnedDockerImage resolves to; if it does not,
+// it is recreated.
 func searchContainer(path string, autostart bool) string {
-	// Check whether there is a container file. This is the fastest and safest
-	// way to find the container associated with this directory, but only works
-	// for directories which are git roots.
-	// Otherwise, if we are requested to mount in a directory which is not a repo
-	// root, there will be no container file to speed up further usage later.
-	containerFile := filepath.Join(path, ".git", CACHED_CONTAINER_FILE)
-
-	if containerBytes, err := os.ReadFile(containerFile); err == nil {
-		container := strings.TrimSpace(string(containerBytes))
-
-		// We want to check whether the container still exists and optionally
-		// start it with the smallest possible amount of docker commands, so
-		// that execution is as fast as possible (for libdragon make).
-		// In fact, the file might be stale (eg: the container has been purged).
-		if autostart {
-			// In case of autostart, we just run "docker start". If that fails,
-			// we assume that the container does not exist anymore (stale file).
-			if err := run("docker", "container", "start", container); err == nil {
-				vprintf("container found: %v\n", container)
-				return container
-			}
-		} else {
-			// If no autostart was requested, we use "docker container ls" to
-			// check whether it still exists.
-			if out := mustOutput("docker", "container", "ls", "-qa", "-f", "id="+container); out[0] != "" {
-				vprintf("container found: %v\n", out[0])
-				return out[0]
-			}
-		}
+	if autostart {
+		return autostartContainer(path, false)
+	}
+
+	rt := mustFindRuntime()
+	container, err := lookupContainer(rt, path)
+	if err != nil {
+		fatal_exitproc(err, rt.Name(), []string{"container", "ls"})
+	}
+	return container
+}
+
+// autostartContainer is the autostart mode of searchContainer. To keep
+// commands like "libdragon make" fast, the image of an existing container is
+// normally checked just by comparing its reference, which changes whenever a
+// different image is configured or pinned; with checkImageID, the image ID
+// is compared too, so that an image pulled again under the same reference is
+// detected (see UsesImage).
+func autostartContainer(path string, checkImageID bool) string {
+	if container, found := startedContainers[path]; found {
+		return container
 	}
 
-	// Fallback: look for containers that mount the same volume
-	out := mustOutput("docker", "container", "ls", "-qa", "-f", "volume="+string(path))
-	if out[0] != "" {
-		vprintf("container found: %v\n", out[0])
-		if autostart {
-			// Restart the container in case it's not running.
-			mustRun("docker", "container", "start", out[0])
+	rt := mustFindRuntime()
+	image := findPinnedDockerImage()
+	user := hostUser()
+
+	// We want to check whether the container still exists and start it with
+	// the smallest possible amount of commands, so that execution is as fast
+	// as possible (for libdragon make).
+	// In fact, the file might be stale (eg: the container has been purged).
+	if container := readContainerFile(path); container != "" {
+		if startContainer(rt, container, image, user, checkImageID) {
+			vprintf("container found: %v\n", container)
+			startedContainers[path] = container
+			return container
 		}
-		return out[0]
 	}
 
-	// No container found. If we were not asked to autostart, there's nothing
-	// more to do.
-	if !autostart {
-		return ""
+	// Fallback: ask the runtime to look for the container
+	container, err := rt.FindContainer(path)
+	if err != nil {
+		fatal_exitproc(err, rt.Name(), []string{"container", "ls"})
+	}
+	if container != "" {
+		vprintf("container found: %v\n", container)
+		if startContainer(rt, container, image, user, checkImageID) {
+			startedContainers[path] = container
+			return container
+		}
 	}
 
-	// Start a new container
-	out = mustOutput("docker", "run",
-		"-e", "IS_DOCKER=true",
-		"-d",                                                       // detached
-		"--mount", "type=bind,source="+path+",target="+VOLUME_ROOT, // mount
-		"-w", "/app", // working dir
-		DOCKER_IMAGE,
-		"tail", "-f", "/dev/null",
-	)
+	// No container found: create it.
+	spec := containerSpec{
+		Path:   path,
+		Image:  image,
+		User:   user,
+		Mounts: containerMounts(path),
+	}
+	container, err = rt.CreateContainer(spec)
+	if err != nil {
+		fatal_exitproc(err, rt.Name(), []string{"run", image})
+	}
 
 	// Try writing the container file. This will fail if this is not a git
 	// root because the .git subdir will not exist. Ignore the error.
-	os.WriteFile(containerFile, []byte(out[0]+"\n"), 0666)
+	os.WriteFile(filepath.Join(path, ".git", CACHED_CONTAINER_FILE), []byte(container+"\n"), 0666)
+
+	startedContainers[path] = container
+	return container
+}
+
+// containerMounts returns the additional mounts configured for the container,
+// with host paths converted to absolute.
+func containerMounts(root string) []mountConfig {
+	var mounts []mountConfig
+	for _, m := range config().Mounts {
+		if !filepath.IsAbs(m.Source) {
+			m.Source = filepath.Join(root, m.Source)
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts
+}
 
-	return out[0]
+// removeOutdatedContainer removes the container associated to the specified
+// path, if it is not running the toolchain image that findPinnedDockerImage
+// resolves to (comparing image IDs), so that it is recreated with the right
+// image the next time it is used.
+func removeOutdatedContainer(path string) {
+	rt := mustFindRuntime()
+	container, err := lookupContainer(rt, path)
+	if err != nil || container == "" {
+		return
+	}
+	info, err := rt.InspectContainer(container)
+	if err != nil || rt.UsesImage(info, findPinnedDockerImage()) {
+		return
+	}
+	progress("Removing the container running the previous toolchain, it will be recreated when used\n")
+	if err := rt.RemoveContainer(container); err != nil {
+		fatal_exitproc(err, rt.Name(), []string{"container", "rm", container})
+	}
+}
+
+// containerUser returns the value of the user label of a container created to
+// run processes as the specified user (see hostUser).
+func containerUser(user string) string {
+	if user == "" {
+		return "root"
+	}
+	return user
+}
+
+// startContainer makes sure that an existing container is running the specified
+// toolchain image as the specified user, and starts it if it is stopped. It
+// returns false if the container does not exist, or if it was running a
+// different image or user, in which case it is removed, so that the caller can
+// create a new one. See autostartContainer for checkImageID.
+func startContainer(rt containerRuntime, container string, image string, user string, checkImageID bool) bool {
+	// If inspection fails, we assume that the container does not exist
+	// anymore.
+	info, err := rt.InspectContainer(container)
+	if err != nil {
+		return false
+	}
+
+	sameImage := normalizeImageRef(info.ImageRef) == normalizeImageRef(image)
+	if checkImageID {
+		sameImage = rt.UsesImage(info, image)
+	}
+	if !sameImage {
+		progress("Toolchain image changed to %s, recreating container...\n", image)
+		if err := rt.RemoveContainer(container); err != nil {
+			fatal_exitproc(err, rt.Name(), []string{"container", "rm", container})
+		}
+		return false
+	}
+
+	// Containers created by older versions do not record the user.
+	if info.User != "" && info.User != containerUser(user) {
+		progress("Container user changed to %s, recreating container...\n", containerUser(user))
+		if err := rt.RemoveContainer(container); err != nil {
+			fatal_exitproc(err, rt.Name(), []string{"container", "rm", container})
+		}
+		return false
+	}
+
+	if !info.Running {
+		if err := rt.StartContainer(container); err != nil {
+			fatal_exitproc(err, rt.Name(), []string{"container", "start", container})
+		}
+	}
+	return true
 }
 
 func doStart(cmd *cobra.Command, args []string) error {
-	path := findGitRootOrCwd()
-	searchContainer(path, true)
+	if findToolchain().Name() == TOOLCHAIN_NATIVE {
+		progress("Native toolchain in use, no container to start\n")
+		return nil
+	}
+	path := findProjectRoot()
+	autostartContainer(path, true)
 	return nil
 }
 
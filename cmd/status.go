@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/gookit/color"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagStatusJSON bool
+)
+
+// projectStatus is a snapshot of the state of the current project, as
+// reported by "libdragon status".
+type projectStatus struct {
+	GitRoot          string `json:"git_root"`
+	Image            string `json:"image"`
+	ImageSource      string `json:"image_source"`
+	ImagePin         string `json:"image_pin,omitempty"`
+	Toolchain        string `json:"toolchain"`
+	N64Inst          string `json:"n64_inst,omitempty"`
+	Runtime          string `json:"runtime"`
+	RuntimeError     string `json:"runtime_error,omitempty"`
+	Container        string `json:"container"`
+	ContainerRunning bool   `json:"container_running"`
+	Vendoring        string `json:"vendoring"`
+	LibdragonPath    string `json:"libdragon_path"`
+	LibdragonCommit  string `json:"libdragon_commit"`
+}
+
+// collectStatus inspects the current project and returns its status. It never
+// starts containers or modifies the repository.
+func collectStatus() projectStatus {
+	var st projectStatus
+
+	root := findProjectRoot()
+	if isGitRepo() {
+		st.GitRoot = root
+	}
+	st.Image, st.ImageSource = findDockerImageSource()
+	if pinned := findPinnedDockerImage(); pinned != st.Image {
+		st.ImagePin = pinned
+	}
+	st.Toolchain = findToolchain().Name()
+	if st.Toolchain == TOOLCHAIN_NATIVE {
+		st.N64Inst = os.Getenv("N64_INST")
+	}
+
+	// Look for the container only if a runtime is available, so that the
+	// status can still be shown on machines where none is installed, or
+	// where the daemon is not running.
+	if rt := findRuntime(); rt != nil {
+		st.Runtime = rt.Name()
+		_, err := exec.LookPath(rt.Name())
+		if err == nil {
+			st.Container, err = lookupContainer(rt, root)
+		}
+		if err != nil {
+			st.RuntimeError = "runtime not available"
+		} else if st.Container != "" {
+			if info, err := rt.InspectContainer(st.Container); err == nil {
+				st.ContainerRunning = info.Running
+			}
+		}
+	}
+
+	libdragonPath, mode := findLibdragon()
+	if libdragonPath != "" {
+		st.LibdragonPath = libdragonPath
+		st.Vendoring = mode
+		switch mode {
+		case VENDOR_SUBMODULE:
+			if out, err := getOutput("git", "-C", filepath.Join(root, libdragonPath), "rev-parse", "HEAD"); err == nil {
+				st.LibdragonCommit = out[0]
+			}
+		case VENDOR_SUBTREE:
+			st.LibdragonCommit = findSubtreeSplit(libdragonPath)
+		case VENDOR_TARBALL:
+			st.LibdragonCommit = config().Libdragon.Version
+		}
+	}
+
+	return st
+}
+
+func doStatus(cmd *cobra.Command, args []string) error {
+	st := collectStatus()
+
+	if flagStatusJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(st)
+	}
+
+	orNone := func(s string) string {
+		if s == "" {
+			return color.Gray.Render("(none)")
+		}
+		return s
+	}
+
+	containerState := "stopped"
+	if st.ContainerRunning {
+		containerState = "running"
+	}
+	if st.Container == "" {
+		containerState = ""
+	}
+
+	vendoring := st.Vendoring
+	if vendoring != "" {
+		vendoring = fmt.Sprintf("%s (%s)", st.Vendoring, st.LibdragonPath)
+	}
+
+	fmt.Printf("%s %s\n", color.Green.Render("Git root:        "), orNone(st.GitRoot))
+	if st.Toolchain == TOOLCHAIN_NATIVE {
+		fmt.Printf("%s native (N64_INST=%s)\n", color.Green.Render("Toolchain:       "), orNone(st.N64Inst))
+	} else {
+		fmt.Printf("%s container\n", color.Green.Render("Toolchain:       "))
+	}
+	fmt.Printf("%s %s (from %s)\n", color.Green.Render("Toolchain image: "), st.Image, st.ImageSource)
+	if st.ImagePin != "" {
+		fmt.Printf("%s %s\n", color.Green.Render("Pinned image:    "), st.ImagePin)
+	}
+	runtime := orNone(st.Runtime)
+	if st.RuntimeError != "" {
+		runtime += " " + color.Red.Render("("+st.RuntimeError+")")
+	}
+
+	fmt.Printf("%s %s\n", color.Green.Render("Runtime:         "), runtime)
+	fmt.Printf("%s %s %s\n", color.Green.Render("Container:       "), orNone(st.Container), containerState)
+	fmt.Printf("%s %s\n", color.Green.Render("Vendoring:       "), orNone(vendoring))
+	fmt.Printf("%s %s\n", color.Green.Render("Libdragon commit:"), orNone(st.LibdragonCommit))
+	return nil
+}
+
+var cmdStatus = &cobra.Command{
+	Use:   "status",
+	Short: "Show the status of the libdragon environment for the current repository.",
+	Example: `  libdragon status
+	-- show container, toolchain and vendoring information
+  libdragon status --json
+	-- same, in a machine-readable format`,
+	Args:         cobra.NoArgs,
+	RunE:         doStatus,
+	SilenceUsage: true,
+}
+
+func init() {
+	cmdStatus.Flags().BoolVarP(&flagStatusJSON, "json", "", false, "output status in JSON format")
+	rootCmd.AddCommand(cmdStatus)
+}
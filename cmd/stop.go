@@ -8,10 +8,13 @@ import (
 )
 
 func doStop(cmd *cobra.Command, args []string) error {
-	path := findGitRootOrCwd()
+	path := findProjectRoot()
 	out := searchContainer(path, false)
 	if out != "" {
-		mustRun("docker", "container", "rm", "--force", out)
+		rt := mustFindRuntime()
+		if err := rt.RemoveContainer(out); err != nil {
+			fatal_exitproc(err, rt.Name(), []string{"container", "rm", out})
+		}
 
 		// Remove the container file if it exists
 		os.Remove(filepath.Join(path, ".git", CACHED_CONTAINER_FILE))
@@ -0,0 +1,628 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// tarballFile is an entry of a source archive, with its path relative to the
+// root of the library.
+type tarballFile struct {
+	name string
+	hdr  *tar.Header
+	data []byte
+}
+
+// tarball is a library source archive, loaded in memory.
+type tarball struct {
+	checksum string // checksum of the archive ("sha256:...")
+	version  string // commit the archive was created from, if recorded by "git archive"
+	files    []tarballFile
+}
+
+// hashBytes returns the hex-encoded SHA-256 hash of data.
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadTarball parses a (possibly gzipped) tar archive. If stripTop is true,
+// the top-level directory that source archives usually have (eg:
+// "libdragon-trunk/") is removed from the paths.
+func loadTarball(data []byte, stripTop bool) (*tarball, error) {
+	tb := &tarball{checksum: "sha256:" + hashBytes(data)}
+
+	var r io.Reader = bytes.NewReader(data)
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			// "git archive" records the commit as a global comment
+			tb.version = strings.TrimSpace(hdr.PAXRecords["comment"])
+			continue
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, fmt.Errorf("invalid path in archive: %s", hdr.Name)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		tb.files = append(tb.files, tarballFile{name: name, hdr: hdr, data: data})
+	}
+	if len(tb.files) == 0 {
+		return nil, fmt.Errorf("empty archive")
+	}
+
+	// Check whether all the files are within the same top-level directory
+	if stripTop {
+		top := strings.SplitN(tb.files[0].name, "/", 2)[0]
+		for _, f := range tb.files {
+			if f.name != top && !strings.HasPrefix(f.name, top+"/") {
+				top = ""
+				break
+			}
+		}
+		if top != "" {
+			files := tb.files[:0]
+			for _, f := range tb.files {
+				if f.name != top {
+					f.name = strings.TrimPrefix(f.name, top+"/")
+					files = append(files, f)
+				}
+			}
+			tb.files = files
+		}
+	}
+
+	// Symlinks must point within the archive, as they are followed when
+	// extracting it. No entry can be extracted through a symlink, and the
+	// targets are resolved through the symlinks that come before them, so
+	// that they cannot be chained to escape.
+	links := make(map[string]string)
+	for _, f := range tb.files {
+		for d := path.Dir(f.name); d != "."; d = path.Dir(d) {
+			if _, found := links[d]; found {
+				return nil, fmt.Errorf("invalid path in archive: %s (through symlink %s)", f.hdr.Name, d)
+			}
+		}
+		if f.hdr.Typeflag == tar.TypeSymlink {
+			if !isLocalLink(links, f.name, f.hdr.Linkname) {
+				return nil, fmt.Errorf("invalid symlink in archive: %s -> %s", f.hdr.Name, f.hdr.Linkname)
+			}
+			links[f.name] = f.hdr.Linkname
+		}
+	}
+	return tb, nil
+}
+
+// isLocalLink returns true if the target of a symlink in an archive is a
+// relative path that does not point outside of the archive, following the
+// specified symlinks of the archive (by path).
+func isLocalLink(links map[string]string, name string, target string) bool {
+	if target == "" || path.IsAbs(target) || strings.ContainsAny(target, "\\:") {
+		return false
+	}
+	_, ok := resolveArchivePath(links, path.Dir(name)+"/"+target, 0)
+	return ok
+}
+
+// resolveArchivePath resolves a slash-separated path within an archive,
+// following the specified symlinks of the archive. It returns false if the
+// path points outside of the archive (or if there are too many symlinks).
+func resolveArchivePath(links map[string]string, p string, depth int) (string, bool) {
+	if depth > 40 {
+		return "", false
+	}
+	var parts []string
+	for _, c := range strings.Split(p, "/") {
+		switch c {
+		case "", ".":
+		case "..":
+			if len(parts) == 0 {
+				return "", false
+			}
+			parts = parts[:len(parts)-1]
+		default:
+			parts = append(parts, c)
+			target, found := links[strings.Join(parts, "/")]
+			if !found {
+				continue
+			}
+			if path.IsAbs(target) {
+				return "", false
+			}
+			resolved, ok := resolveArchivePath(links, strings.Join(parts[:len(parts)-1], "/")+"/"+target, depth+1)
+			if !ok {
+				return "", false
+			}
+			parts = nil
+			if resolved != "" {
+				parts = strings.Split(resolved, "/")
+			}
+		}
+	}
+	return strings.Join(parts, "/"), true
+}
+
+// checkNoSymlinks returns an error if any of the directories leading to the
+// specified file (a slash-separated path within dir) is a symlink, so that
+// nothing is written outside of dir through symlinks that were already there.
+func checkNoSymlinks(dir string, name string) error {
+	for d := path.Dir(name); d != "."; d = path.Dir(d) {
+		if fi, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(d))); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("cannot extract %s: %s is a symlink", name, d)
+		}
+	}
+	return nil
+}
+
+// extract extracts the archive in the specified directory, and writes the
+// manifest of the extracted files (see writeTarballManifest).
+func (tb *tarball) extract(dir string) error {
+	manifest, err := tb.extractFiles(dir)
+	if err != nil {
+		return err
+	}
+	return writeTarballManifest(dir, tb.checksum, manifest)
+}
+
+// extractFiles extracts the archive in the specified directory, and returns
+// the hashes of the extracted regular files, by path.
+func (tb *tarball) extractFiles(dir string) (map[string]string, error) {
+	manifest := make(map[string]string)
+	for _, f := range tb.files {
+		target := filepath.Join(dir, filepath.FromSlash(f.name))
+		if err := checkNoSymlinks(dir, f.name); err != nil {
+			return nil, err
+		}
+		mode := f.hdr.FileInfo().Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, 0777); err != nil {
+				return nil, err
+			}
+		case mode.IsRegular():
+			if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+				return nil, err
+			}
+			os.Remove(target)
+			if err := os.WriteFile(target, f.data, mode.Perm()|0600); err != nil {
+				return nil, err
+			}
+			manifest[f.name] = hashBytes(f.data)
+		case mode&os.ModeSymlink != 0:
+			// Symlinks might not be supported (eg: on Windows), and are
+			// not required to build libdragon, so ignore failures.
+			os.Remove(target)
+			if err := os.Symlink(f.hdr.Linkname, target); err != nil {
+				vprintf("cannot create symlink %s: %v\n", target, err)
+			}
+		}
+	}
+	return manifest, nil
+}
+
+// writeTarballManifest writes the manifest of a vendored archive, which lists
+// the files that were extracted from it, together with their hashes, so that
+// local changes can be detected.
+func writeTarballManifest(dir string, checksum string, manifest map[string]string) error {
+	var names []string
+	for name := range manifest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Files extracted by libdragon from archive %s. Do not edit.\n", checksum)
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s  %s\n", manifest[name], name)
+	}
+	return os.WriteFile(filepath.Join(dir, TARBALL_MANIFEST), buf.Bytes(), 0666)
+}
+
+// readTarballManifest reads the manifest of a vendored archive, as a map from
+// file paths to their hashes.
+func readTarballManifest(dir string) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(dir, TARBALL_MANIFEST))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	manifest := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if fields := strings.SplitN(line, "  ", 2); len(fields) == 2 {
+			manifest[fields[1]] = fields[0]
+		}
+	}
+	return manifest, scanner.Err()
+}
+
+// tarballChanges returns the files of a vendored archive that were modified
+// or deleted, as sorted slash-separated paths. Files that were added are not
+// considered, as they are usually build artifacts.
+func tarballChanges(dir string) ([]string, error) {
+	manifest, err := readTarballManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	for name, hash := range manifest {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil || hashBytes(data) != hash {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// tarballHash returns a hash of the current content of the files extracted
+// from a vendored archive.
+func tarballHash(dir string) (string, error) {
+	manifest, err := readTarballManifest(dir)
+	if err != nil {
+		return "", err
+	}
+	var names []string
+	for name := range manifest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		hash := "-"
+		if data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name))); err == nil {
+			hash = hashBytes(data)
+		}
+		fmt.Fprintf(h, "%s  %s\n", hash, name)
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// removeTarballFiles removes the files extracted from a vendored archive, and
+// the directories left empty, so that a new version can be extracted. Other
+// files (eg: build artifacts) are left untouched.
+func removeTarballFiles(dir string) error {
+	manifest, err := readTarballManifest(dir)
+	if err != nil {
+		return err
+	}
+	dirs := make(map[string]bool)
+	for name := range manifest {
+		os.Remove(filepath.Join(dir, filepath.FromSlash(name)))
+		for d := path.Dir(name); d != "."; d = path.Dir(d) {
+			dirs[d] = true
+		}
+	}
+
+	// Remove the deepest directories first. Non-empty directories are
+	// not removed.
+	var names []string
+	for d := range dirs {
+		names = append(names, d)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, d := range names {
+		os.Remove(filepath.Join(dir, filepath.FromSlash(d)))
+	}
+	return os.Remove(filepath.Join(dir, TARBALL_MANIFEST))
+}
+
+// splitLines splits a text in lines, each one terminated by a newline, as
+// expected by difflib.
+func splitLines(text []byte) []string {
+	if len(text) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(text), "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+	lines[len(lines)-1] += "\n"
+	return lines
+}
+
+// localPatchFile returns the path of the file in which the local changes to
+// a vendored archive are saved: LOCAL_PATCH_FILE in the project root, or, if
+// it already exists, the first free name among "libdragon-local-1.patch",
+// "libdragon-local-2.patch", and so on.
+func localPatchFile(root string) string {
+	name := LOCAL_PATCH_FILE
+	ext := filepath.Ext(name)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(filepath.Join(root, name)); os.IsNotExist(err) {
+			return filepath.Join(root, name)
+		}
+		name = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(LOCAL_PATCH_FILE, ext), i, ext)
+	}
+}
+
+// writeTarballPatch writes a patch with the local changes made to the
+// specified files of a vendored archive, compared to their original content
+// in the archive. The patch can be applied with "patch -p1".
+func writeTarballPatch(dir string, tb *tarball, changed []string, patchFile string) error {
+	original := make(map[string][]byte)
+	for _, f := range tb.files {
+		original[f.name] = f.data
+	}
+
+	var buf bytes.Buffer
+	for _, name := range changed {
+		from, to := "a/"+name, "b/"+name
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			to = "/dev/null"
+		} else if err != nil {
+			return err
+		}
+		if bytes.IndexByte(original[name], 0) >= 0 || bytes.IndexByte(data, 0) >= 0 {
+			fmt.Fprintf(&buf, "Binary files %s and %s differ\n", from, to)
+			continue
+		}
+		diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        splitLines(original[name]),
+			B:        splitLines(data),
+			FromFile: from,
+			ToFile:   to,
+			Context:  3,
+		})
+		if err != nil {
+			return err
+		}
+		buf.WriteString(diff)
+	}
+	// Never overwrite a patch saved by a previous update
+	f, err := os.OpenFile(patchFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// tarballSource returns the URL (or path) of the source archive for the
+// specified vendoring configuration: the configured archive, or otherwise the
+// archive of the configured ref (or branch) of the upstream repository, in the
+// format used by GitHub.
+func tarballSource(cfg vendorConfig) string {
+	if cfg.Archive != "" {
+		return cfg.Archive
+	}
+	ref := cfg.Ref
+	if ref == "" {
+		ref = cfg.Branch
+	}
+	return strings.TrimSuffix(cfg.Remote, ".git") + "/archive/" + ref + ".tar.gz"
+}
+
+// tarballCacheFile returns the path where an archive with the specified
+// checksum is cached, or an empty string if there is no cache directory.
+func tarballCacheFile(checksum string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "libdragon", "tarballs", strings.TrimPrefix(checksum, "sha256:")+".tar")
+}
+
+// fetchTarball downloads (or reads, for local paths) a source archive. Paths
+// are relative to the project root. The archive is also cached, so that the
+// vendored version can be compared with local changes later.
+func fetchTarball(source string) (*tarball, error) {
+	var data []byte
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := http.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: %s", source, resp.Status)
+		}
+		if data, err = io.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		if !filepath.IsAbs(source) {
+			source = filepath.Join(findProjectRoot(), source)
+		}
+		var err error
+		if data, err = os.ReadFile(source); err != nil {
+			return nil, err
+		}
+	}
+
+	tb, err := loadTarball(data, true)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", source, err)
+	}
+	if cache := tarballCacheFile(tb.checksum); cache != "" {
+		if err := os.MkdirAll(filepath.Dir(cache), 0777); err == nil {
+			os.WriteFile(cache, data, 0666)
+		}
+	}
+	return tb, nil
+}
+
+// vendoredTarball returns the archive that was vendored with the specified
+// configuration, from the cache or otherwise by downloading it again.
+func vendoredTarball(cfg vendorConfig) (*tarball, error) {
+	if cache := tarballCacheFile(cfg.Checksum); cache != "" {
+		if data, err := os.ReadFile(cache); err == nil {
+			return loadTarball(data, true)
+		}
+	}
+
+	// Download the exact version that was vendored, if it is known.
+	if cfg.Archive == "" && cfg.Version != "" {
+		cfg.Ref = cfg.Version
+	}
+	tb, err := fetchTarball(tarballSource(cfg))
+	if err != nil {
+		return nil, err
+	}
+	if tb.checksum != cfg.Checksum && (tb.version == "" || tb.version != cfg.Version) {
+		return nil, fmt.Errorf("the archive has changed since it was vendored")
+	}
+	return tb, nil
+}
+
+// vendorTarball vendors libdragon in the specified project-relative path, by
+// extracting the source archive, and records it in the project configuration.
+func vendorTarball(libdragonPath string) {
+	dir := filepath.Join(findProjectRoot(), libdragonPath)
+	if _, err := os.Stat(dir); err == nil {
+		fatal("%s already exists\n", dir)
+	}
+
+	source := tarballSource(config().Libdragon)
+	progress("Downloading %s...\n", source)
+	tb, err := fetchTarball(source)
+	if err != nil {
+		fatal("error downloading libdragon: %v\n", err)
+	}
+	if err := tb.extract(dir); err != nil {
+		fatal("error extracting libdragon: %v\n", err)
+	}
+
+	setLibdragonVendoring(libdragonPath, VENDOR_TARBALL)
+	pcfg := projectConfigForUpdate()
+	pcfg.Libdragon.Version = tb.version
+	pcfg.Libdragon.Checksum = tb.checksum
+	saveProjectConfig()
+}
+
+// updateLibdragonTarball updates libdragon vendored as a source archive in
+// the specified project-relative path, by replacing the files extracted from
+// the previous archive. Local changes to them are saved as a patch.
+func updateLibdragonTarball(libdragonPath string) {
+	dir := filepath.Join(findProjectRoot(), libdragonPath)
+	cfg := config().Libdragon
+
+	newCfg := cfg
+	newCfg.Remote, newCfg.Branch, newCfg.Ref = requestedLibdragonUpstream()
+	if flagUpdateArchive != "" {
+		newCfg.Archive = flagUpdateArchive
+	}
+
+	source := tarballSource(newCfg)
+	progress("Downloading %s...\n", source)
+	tb, err := fetchTarball(source)
+	if err != nil {
+		fatal("error downloading libdragon: %v\n", err)
+	}
+	if tb.checksum == cfg.Checksum {
+		progress("libdragon is already up to date\n")
+	} else {
+		progress("Updating libdragon from version %s to %s\n", orUnknown(cfg.Version), orUnknown(tb.version))
+	}
+
+	changed, err := tarballChanges(dir)
+	if err != nil {
+		fatal("error reading %s: %v\n", filepath.Join(dir, TARBALL_MANIFEST), err)
+	}
+	if len(changed) > 0 && tb.checksum != cfg.Checksum {
+		critical("libdragon has %d locally modified files:\n", len(changed))
+		for _, name := range changed {
+			fmt.Println("  " + name)
+		}
+	}
+	if flagUpdateDryRun {
+		return
+	}
+
+	if tb.checksum != cfg.Checksum {
+		if !flagUpdateYes && !confirm("Update libdragon?") {
+			fatal("update aborted\n")
+		}
+
+		// Save local changes before replacing the files
+		if len(changed) > 0 {
+			if old, err := vendoredTarball(cfg); err != nil {
+				critical("cannot retrieve the vendored libdragon archive to save local changes: %v\n", err)
+				if !flagUpdateYes && !confirm("Discard local changes?") {
+					fatal("update aborted\n")
+				}
+			} else {
+				patchFile := localPatchFile(findProjectRoot())
+				if err := writeTarballPatch(dir, old, changed, patchFile); err != nil {
+					fatal("error writing %s: %v\n", patchFile, err)
+				}
+				progress("Local changes saved to %s\n", filepath.Base(patchFile))
+				progress("To apply them again, run: patch -p1 -d %s < %s\n", libdragonPath, filepath.Base(patchFile))
+			}
+		}
+
+		if err := removeTarballFiles(dir); err != nil {
+			fatal("error removing libdragon: %v\n", err)
+		}
+		if err := tb.extract(dir); err != nil {
+			fatal("error extracting libdragon: %v\n", err)
+		}
+	}
+
+	pcfg := projectConfigForUpdate()
+	pcfg.Libdragon.Remote = newCfg.Remote
+	pcfg.Libdragon.Branch = newCfg.Branch
+	pcfg.Libdragon.Ref = newCfg.Ref
+	pcfg.Libdragon.Archive = newCfg.Archive
+	pcfg.Libdragon.Version = tb.version
+	pcfg.Libdragon.Checksum = tb.checksum
+	saveProjectConfig()
+
+	// Record the vendored version in the lockfile
+	lock := readLockFile()
+	lock.Libdragon = &vendorLock{
+		Remote:   source,
+		Commit:   tb.version,
+		Vendored: vendoredHash(libdragonPath, VENDOR_TARBALL),
+	}
+	writeLockFile(lock)
+}
+
+// orUnknown returns s, or "unknown" if s is empty.
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// testArchive builds a tar archive with the specified entries: names ending
+// with "/" are directories, "name -> target" are symlinks, and the others are
+// regular files.
+func testArchive(entries ...string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e, Typeflag: tar.TypeReg, Mode: 0644}
+		if i := strings.Index(e, " -> "); i >= 0 {
+			hdr = &tar.Header{Name: e[:i], Typeflag: tar.TypeSymlink, Linkname: e[i+4:], Mode: 0777}
+		} else if e[len(e)-1] == '/' {
+			hdr = &tar.Header{Name: e, Typeflag: tar.TypeDir, Mode: 0755}
+		}
+		tw.WriteHeader(hdr)
+	}
+	tw.Close()
+	return buf.Bytes()
+}
+
+func TestLoadTarballSymlinks(t *testing.T) {
+	tests := []struct {
+		entries []string
+		ok      bool
+	}{
+		{[]string{"lib/a.c", "lib/b.c -> a.c"}, true},
+		{[]string{"lib/src/", "lib/src/a.c", "lib/inc -> src"}, true},
+		{[]string{"lib/x/y/", "lib/x/y/up -> ../.."}, true},
+		{[]string{"lib/a.c", "lib/etc -> /etc"}, false},
+		{[]string{"lib/a.c", "lib/up -> .."}, false},
+		{[]string{"lib/a.c", "lib/x/up -> ../../.."}, false},
+		{[]string{"lib/a.c", "lib/win -> C:\\Windows"}, false},
+
+		// Chained symlinks
+		{[]string{"lib/a.c", "lib/a -> .", "lib/a/b -> .."}, false},
+		{[]string{"lib/a.c", "lib/a -> .", "lib/x -> a/.."}, false},
+		{[]string{"lib/d/", "lib/a -> d", "lib/x -> a/.."}, true},
+		{[]string{"lib/a.c", "lib/a -> b", "lib/b -> a", "lib/c -> a/x"}, false},
+
+		// Files written through symlinks
+		{[]string{"lib/d/", "lib/a -> d", "lib/a/x.c"}, false},
+	}
+	for _, tt := range tests {
+		_, err := loadTarball(testArchive(tt.entries...), true)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("loadTarball(%q): error = %v, want ok = %v", tt.entries, err, tt.ok)
+		}
+	}
+}
+
+func TestResolveArchivePath(t *testing.T) {
+	links := map[string]string{"a": "d/e", "b": "a/..", "c": "../x"}
+	tests := []struct {
+		path string
+		want string
+		ok   bool
+	}{
+		{"x/y", "x/y", true},
+		{"x/../y", "y", true},
+		{"a/f", "d/e/f", true},
+		{"b", "d", true},
+		{"a/../..", "", true},
+		{"a/../../..", "", false},
+		{"c", "", false},
+		{"..", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := resolveArchivePath(links, tt.path, 0)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("resolveArchivePath(%q) = %q, %v, want %q, %v", tt.path, got, ok, tt.want, tt.ok)
+		}
+	}
+}
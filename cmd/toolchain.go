@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// toolchainEnv is an environment in which the libdragon toolchain can be run.
+type toolchainEnv interface {
+	// Name returns the name of the environment (one of the TOOLCHAIN_*
+	// constants).
+	Name() string
+
+	// Exec runs a command using the toolchain. If the command fails, an
+	// exitCodeError is returned with its exit code.
+	Exec(opts execOptions, args ...string) error
+
+	// ShellCommand returns the command to run an interactive shell.
+	ShellCommand() []string
+}
+
+// findToolchain returns the toolchain environment selected by the user. By
+// default, the toolchain is run within a container, but a native toolchain
+// (installed in $N64_INST) can be selected via the LIBDRAGON_TOOLCHAIN
+// environment variable or the "toolchain.mode" configuration option (either
+// in the project, or in the user configuration).
+func findToolchain() toolchainEnv {
+	name := os.Getenv(TOOLCHAIN_ENV)
+	if name == "" {
+		name = config().Toolchain.Mode
+	}
+	if name == "" {
+		name = TOOLCHAIN_CONTAINER
+	}
+	switch name {
+	case TOOLCHAIN_CONTAINER:
+		return &containerToolchain{}
+	case TOOLCHAIN_NATIVE:
+		return &nativeToolchain{}
+	}
+	fatal("unsupported toolchain mode: %s (use %q or %q)\n", name, TOOLCHAIN_CONTAINER, TOOLCHAIN_NATIVE)
+	return nil
+}
+
+// spawnToolchain runs a command using the toolchain, using the default options.
+func spawnToolchain(args ...string) error {
+	return findToolchain().Exec(defaultExecOptions(), args...)
+}
+
+// captureToolchain runs a command using the toolchain, and returns its output.
+// The command does not get a TTY.
+func captureToolchain(args ...string) ([]byte, error) {
+	var buf bytes.Buffer
+	err := findToolchain().Exec(execOptions{output: &buf}, args...)
+	return buf.Bytes(), err
+}
+
+// nativeToolchain runs the toolchain directly on the host, from the
+// installation pointed by $N64_INST.
+type nativeToolchain struct{}
+
+func (t *nativeToolchain) Name() string {
+	return TOOLCHAIN_NATIVE
+}
+
+func (t *nativeToolchain) ShellCommand() []string {
+	if runtime.GOOS == "windows" {
+		if shell := os.Getenv("COMSPEC"); shell != "" {
+			return []string{shell}
+		}
+		return []string{"cmd.exe"}
+	}
+	if shell := os.Getenv("SHELL"); shell != "" {
+		return []string{shell}
+	}
+	return []string{"sh"}
+}
+
+// mustFindN64Inst returns the native toolchain installation directory, and
+// aborts with fatal if it is not configured or it does not contain a toolchain.
+func mustFindN64Inst() string {
+	n64inst := os.Getenv("N64_INST")
+	if n64inst == "" {
+		fatal("error: native toolchain requires N64_INST to be set to the toolchain installation directory\n")
+	}
+	gcc := filepath.Join(n64inst, "bin", "mips64-elf-gcc")
+	if runtime.GOOS == "windows" {
+		gcc += ".exe"
+	}
+	if !isFile(gcc) {
+		fatal("error: N64_INST does not point to a valid toolchain installation (%s not found)\n", gcc)
+	}
+	return n64inst
+}
+
+// Exec runs a command on the host, in the current directory, with the
+// toolchain binaries available in PATH.
+func (t *nativeToolchain) Exec(opts execOptions, args ...string) error {
+	n64inst := mustFindN64Inst()
+
+	// Prepend the toolchain to PATH, so that its tools can be run by name
+	// like in the container. This is done in our own environment, as it
+	// also affects the lookup of the command itself.
+	bindir := filepath.Join(n64inst, "bin")
+	path := os.Getenv("PATH")
+	if !strings.HasPrefix(path, bindir+string(os.PathListSeparator)) {
+		os.Setenv("PATH", bindir+string(os.PathListSeparator)+path)
+	}
+
+	for _, e := range configEnv() {
+		kv := strings.SplitN(e, "=", 2)
+		os.Setenv(kv[0], kv[1])
+	}
+
+	var stdout io.Writer = os.Stdout
+	if opts.output != nil {
+		stdout = opts.output
+	}
+	code, err := spawnRedirect(nil, stdout, os.Stderr, args[0], args[1:]...)
+	if err != nil {
+		fatal_exitproc(err, args[0], args[1:])
+	}
+	if code != 0 {
+		return &exitCodeError{code}
+	}
+	return nil
+}
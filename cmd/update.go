@@ -1,7 +1,7 @@
 package cmd
 
 import (
-	"os"
+	"fmt"
 	"path/filepath"
 	"strings"
 
@@ -13,35 +13,112 @@ var (
 	flagUpdateDockerImage   string
 	flagUpdateLibdragonPath string
 	flagUpdateWhat          string
+	flagUpdateRemote        string
+	flagUpdateBranch        string
+	flagUpdateRef           string
+	flagUpdateRefSet        bool
+	flagUpdateRefresh       bool
+	flagUpdateYes           bool
+	flagUpdateDryRun        bool
+	flagUpdateArchive       string
 )
 
 // updateToolchain updates the docker toolchain image that will be used to compile
-// libdragon. It is a wrapper over "docker pull".
+// libdragon. It is a wrapper over "docker pull" (or the equivalent command of
+// the container runtime in use).
 func updateToolchain() {
 	var image string
 
 	if flagUpdateDockerImage != "" {
 		image = flagUpdateDockerImage
 
-		// Persist the image name by creating a local file in the repo root.
-		// Users might want to commit this file to persist their custom
-		// toolchain selection
-		repoRoot := findGitRootOrCwd()
-		if err := os.WriteFile(filepath.Join(repoRoot, CACHED_IMAGE_FILE), []byte(image+"\n"), 0666); err != nil {
-			fatal("error persisting toolchain change: %v\n", err)
-		}
+		// Persist the image name in the project configuration. Users might
+		// want to commit it to persist their custom toolchain selection.
+		projectConfigForUpdate().Toolchain.Image = image
+		saveProjectConfig()
 	} else {
 		image = findDockerImage()
 	}
 
+	// With a native toolchain there is nothing to download, but the image
+	// choice is still persisted above, in case the container is used later.
+	if findToolchain().Name() == TOOLCHAIN_NATIVE {
+		progress("Native toolchain in use, skipping download of %s\n", image)
+		return
+	}
+
+	// If the image was already pulled, keep using the same version unless
+	// the user explicitly asked to refresh it, so that all the developers of
+	// a project build with the same toolchain.
+	rt := mustFindRuntime()
+	lock := readLockFile()
+	if lock.Toolchain != nil && lock.Toolchain.Image == image && lock.Toolchain.Digest != "" && !flagUpdateRefresh {
+		progress("Toolchain pinned to %s (use --refresh to update it)\n", lock.Toolchain.Digest)
+		if err := rt.Pull(lock.Toolchain.Digest); err != nil {
+			fatal_exitproc(err, rt.Name(), []string{"pull", lock.Toolchain.Digest})
+		}
+		removeOutdatedContainer(findProjectRoot())
+		return
+	}
+
 	// Pull the requested image
-	spawn("docker", "pull", image)
+	if err := rt.Pull(image); err != nil {
+		fatal_exitproc(err, rt.Name(), []string{"pull", image})
+	}
 
+	// Pin the pulled image in the lockfile. Images that do not come from a
+	// registry (eg: built locally) have no digest, and cannot be pinned.
+	digest, err := rt.ImageDigest(image)
+	if err != nil {
+		critical("warning: cannot pin image %s: %v\n", image, err)
+		if lock.Toolchain != nil {
+			lock.Toolchain = nil
+			writeLockFile(lock)
+		}
+		removeOutdatedContainer(findProjectRoot())
+		return
+	}
+	if lock.Toolchain != nil && lock.Toolchain.Digest != digest {
+		progress("Toolchain pin moved from %s to %s\n", lock.Toolchain.Digest, digest)
+	}
+	lock.Toolchain = &toolchainLock{
+		Image:  image,
+		Digest: digest,
+	}
+	writeLockFile(lock)
+	removeOutdatedContainer(findProjectRoot())
+}
+
+// requestedLibdragonUpstream returns the libdragon upstream remote, branch
+// and ref to update from: the configured ones, unless overridden on the
+// command line.
+func requestedLibdragonUpstream() (string, string, string) {
+	cfg := config()
+	remote, branch, ref := cfg.Libdragon.Remote, cfg.Libdragon.Branch, cfg.Libdragon.Ref
+	if flagUpdateRemote != "" {
+		remote = flagUpdateRemote
+	}
+	if flagUpdateBranch != "" {
+		branch = flagUpdateBranch
+	}
+	if flagUpdateRefSet {
+		ref = flagUpdateRef
+	}
+	return remote, branch, ref
 }
 
 // updateLibdragon updates the vendored libdragon copy within the repository.
-// It works with both the submodule and subtree vendoring strategy.
+// It works with the submodule, subtree and tarball vendoring strategy.
 func updateLibdragon() {
+	// Tarballs are updated without git, so they must be handled before
+	// looking for the repository.
+	if flagUpdateLibdragonPath == "" {
+		if path, mode := findLibdragon(); mode == VENDOR_TARBALL {
+			updateLibdragonTarball(path)
+			return
+		}
+	}
+
 	repoRoot := mustFindGitRoot()
 
 	// Repo-relative path where libdragon is vendored
@@ -50,10 +127,12 @@ func updateLibdragon() {
 
 	if flagUpdateLibdragonPath == "" {
 		// If the directory was not specified on a command line, search for it.
-		libdragonPath, useSubmodules = findLibdragon()
+		var mode string
+		libdragonPath, mode = findLibdragon()
 		if libdragonPath == "" {
 			fatal("cannot find libdragon in this repository\nuse --directory to specify the location\n")
 		}
+		useSubmodules = mode == VENDOR_SUBMODULE
 	} else {
 		// If the directory was specified on the command line, we assume that
 		// it's a cwd-relative path (so a path that makes sense for the user
@@ -87,16 +166,258 @@ func updateLibdragon() {
 		vprintf("(subtree)\n")
 	}
 
-	// Update libdragon
-	if useSubmodules {
-		spawn("git", "submodule", "update", "--remote", "--merge", filepath.Join(repoRoot, libdragonPath))
+	// Check whether the upstream repository is being changed
+	cfg := config()
+	remote, branch, ref := requestedLibdragonUpstream()
+	lib := vendoredRepo{name: "libdragon", path: libdragonPath, submodule: useSubmodules}
+	head := gitHead(repoRoot)
+	upstream, ok := lib.update(cfg.Libdragon, remote, branch, ref, filepath.Join(repoRoot, PATCHES_DIR))
+	if !ok {
+		return
+	}
+
+	// Persist the new upstream in the project configuration.
+	if !sameGitRemote(remote, cfg.Libdragon.Remote) || branch != cfg.Libdragon.Branch || ref != cfg.Libdragon.Ref {
+		pcfg := projectConfigForUpdate()
+		pcfg.Libdragon.Remote = remote
+		pcfg.Libdragon.Branch = branch
+		pcfg.Libdragon.Ref = ref
+		saveProjectConfig()
+	}
+
+	// Record the vendored version in the lockfile
+	lock := readLockFile()
+	lock.Libdragon = &vendorLock{
+		Remote:   remote,
+		Commit:   upstream,
+		Vendored: vendoredHash(libdragonPath, lib.mode()),
+	}
+	writeLockFile(lock)
+	lib.commitUpdate(head)
+}
+
+// gitHead returns the commit checked out in the specified repository, or an
+// empty string if there is none.
+func gitHead(repoRoot string) string {
+	out, err := getOutput("git", "-C", repoRoot, "rev-parse", "HEAD")
+	if err != nil {
+		return ""
+	}
+	return out[0]
+}
+
+// isAbbrevHash returns true if ref looks like an abbreviated commit hash.
+func isAbbrevHash(ref string) bool {
+	if len(ref) < 4 || len(ref) >= 40 {
+		return false
+	}
+	for _, c := range ref {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// fetchUpstream fetches the specified branch, or ref if not empty, from the
+// remote into the git repository dir, and returns the fetched commit. Remotes
+// only accept full commit hashes, so for abbreviated ones the branch is
+// fetched instead, and they are looked up in it.
+func fetchUpstream(dir, remote, branch, ref string) string {
+	if ref != "" && !isAbbrevHash(ref) {
+		spawn("git", "-C", dir, "fetch", remote, ref)
+		return mustOutput("git", "-C", dir, "rev-parse", "FETCH_HEAD^{commit}")[0]
+	}
+	spawn("git", "-C", dir, "fetch", remote, branch)
+	if ref == "" {
+		return mustOutput("git", "-C", dir, "rev-parse", "FETCH_HEAD^{commit}")[0]
+	}
+
+	out, err := getOutput("git", "-C", dir, "rev-parse", "-q", "--verify", ref+"^{commit}")
+	if err != nil || run("git", "-C", dir, "merge-base", "--is-ancestor", out[0], "FETCH_HEAD") != nil {
+		fatal("cannot find commit %s in branch %s of %s (use the full commit hash)\n", ref, branch, remote)
+	}
+	return out[0]
+}
+
+// vendoredRepo is a library vendored in the repository with git.
+type vendoredRepo struct {
+	name      string // name of the library, used in messages
+	path      string // repo-relative path of the vendored copy
+	submodule bool   // true if vendored as a submodule, false if as a subtree
+}
+
+// mode returns the vendoring mode of the library (VENDOR_SUBTREE or
+// VENDOR_SUBMODULE).
+func (lib vendoredRepo) mode() string {
+	if lib.submodule {
+		return VENDOR_SUBMODULE
+	}
+	return VENDOR_SUBTREE
+}
+
+// commitUpdate records the project configuration and the lockfile, as saved
+// after an update of the library, together with the update itself. If the
+// update was committed by "git subtree" (HEAD moved from head), they are
+// amended into its commit; otherwise, they are staged together with the
+// submodule (and its configuration), for the user to commit.
+func (lib vendoredRepo) commitUpdate(head string) {
+	repoRoot := mustFindGitRoot()
+	var files []string
+	for _, name := range []string{CONFIG_FILE, LOCK_FILE} {
+		if isFile(filepath.Join(repoRoot, name)) {
+			files = append(files, name)
+		}
+	}
+	if len(files) > 0 {
+		mustRun("git", append([]string{"-C", repoRoot, "add", "--"}, files...)...)
+	}
+
+	if !lib.submodule && gitHead(repoRoot) != head {
+		if len(files) > 0 {
+			mustRun("git", append([]string{"-C", repoRoot, "commit", "--amend", "--no-edit", "--"}, files...)...)
+		}
+		return
+	}
+
+	if lib.submodule {
+		// .gitmodules changes when the upstream is switched.
+		mustRun("git", "-C", repoRoot, "add", "--", lib.path, ".gitmodules")
+		files = append(files, lib.path, ".gitmodules")
+	}
+	if len(files) > 0 && run("git", append([]string{"-C", repoRoot, "diff", "--cached", "--quiet", "--"}, files...)...) != nil {
+		progress("The update of %s is staged, commit it to complete it\n", lib.name)
+	}
+}
+
+// update updates the vendored library from the specified upstream remote,
+// branch and ref (if not empty, the library is pinned to it). cur is the
+// current vendoring configuration, used to detect a change of upstream.
+// The upstream changes are shown and confirmed by the user first, and local
+// commits to the library can be exported to patchDir. It returns the upstream
+// commit that is now vendored, and false if nothing was done (--dry-run).
+func (lib vendoredRepo) update(cur vendorConfig, remote, branch, ref, patchDir string) (string, bool) {
+	repoRoot := mustFindGitRoot()
+
+	changed := !sameGitRemote(remote, cur.Remote) || branch != cur.Branch
+	if changed {
+		progress("Switching %s upstream from %s (%s) to %s (%s)\n",
+			lib.name, cur.Remote, cur.Branch, remote, branch)
+	}
+	if ref != "" {
+		progress("Updating %s to pinned ref: %s\n", lib.name, ref)
+	}
+
+	// Fetch the new upstream commit, and find out which one is currently
+	// vendored. The fetch is done from the URL, so that nothing is modified
+	// until the user confirms the update.
+	submodulePath := filepath.Join(repoRoot, lib.path)
+	var gitDir, current, upstream string
+	if lib.submodule {
+		gitDir = submodulePath
+		current = mustOutput("git", "-C", gitDir, "rev-parse", "HEAD")[0]
 	} else {
-		spawn("git", "subtree", "pull", "--prefix", libdragonPath, LIBDRAGON_GIT, LIBDRAGON_BRANCH, "--squash")
+		gitDir = repoRoot
+		current = findSubtreeSplit(lib.path)
+	}
+	upstream = fetchUpstream(gitDir, remote, branch, ref)
+
+	var local []string
+	if current == upstream {
+		progress("%s is already up to date\n", lib.name)
+	} else {
+		showUpstreamChanges(lib.name, gitDir, current, upstream)
+
+		// Local changes might conflict with the update, so list them, and
+		// offer to export them so that they are not lost.
+		if local = localVendoredCommits(lib.path, lib.submodule); len(local) > 0 {
+			critical("%s has %d local commits, which might conflict with the update:\n", lib.name, len(local))
+			for _, c := range local {
+				fmt.Println("  " + c)
+			}
+			if !flagUpdateDryRun && !flagUpdateYes && confirm("Export them as patches to %s?", patchDir) {
+				exportVendoredPatches(lib.path, lib.submodule, patchDir)
+			}
+		}
+	}
+	if flagUpdateDryRun {
+		return "", false
+	}
+
+	if current != upstream {
+		if !flagUpdateYes && !confirm("Update %s?", lib.name) {
+			fatal("update aborted\n")
+		}
+		if lib.submodule {
+			if changed {
+				// These commands need the repo-relative path: with an
+				// absolute path, set-url adds a new submodule entry.
+				path := filepath.ToSlash(lib.path)
+				spawn("git", "-C", repoRoot, "submodule", "set-url", "--", path, remote)
+				spawn("git", "-C", repoRoot, "submodule", "set-branch", "--branch", branch, "--", path)
+				spawn("git", "-C", repoRoot, "submodule", "sync", "--", path)
+			}
+			// Move to the exact commit shown above, even if the
+			// upstream branch moved in the meantime. Local commits are
+			// kept by merging it, like a subtree update does.
+			if len(local) > 0 {
+				spawn("git", "-C", submodulePath, "merge", "--no-edit", upstream)
+			} else {
+				spawn("git", "-C", submodulePath, "checkout", "--detach", upstream)
+			}
+		} else {
+			spawn("git", "-C", repoRoot, "subtree", "merge", "--prefix", lib.path, "--squash", upstream)
+		}
+	}
+	return upstream, true
+}
+
+// showUpstreamChanges prints the upstream commits between the vendored commit
+// of a library and the new one. dir is the git repository where both commits
+// are available.
+func showUpstreamChanges(name, dir, current, upstream string) {
+	switch {
+	case current == "":
+		critical("Cannot find the vendored %s commit. Latest upstream commits:\n", name)
+		spawn("git", "--no-pager", "-C", dir, "log", "--oneline", "-n", "20", upstream)
+	case run("git", "-C", dir, "merge-base", "--is-ancestor", current, upstream) == nil:
+		progress("Changes in %s since the vendored commit (%s):\n", name, shortHash(current))
+		spawn("git", "--no-pager", "-C", dir, "log", "--oneline", "--no-merges", current+".."+upstream)
+	case run("git", "-C", dir, "merge-base", "--is-ancestor", upstream, current) == nil:
+		critical("%s will be downgraded. Changes that will be reverted:\n", name)
+		spawn("git", "--no-pager", "-C", dir, "log", "--oneline", "--no-merges", upstream+".."+current)
+	default:
+		// Pulling a subtree from a different history would create lots of
+		// conflicts, so make sure the user knows.
+		critical("The new upstream does not contain the vendored %s commit (%s).\n", name, shortHash(current))
+		critical("Pulling from a different history is likely to cause conflicts. Latest upstream commits:\n")
+		spawn("git", "--no-pager", "-C", dir, "log", "--oneline", "-n", "20", upstream)
+	}
+}
+
+// shortHash abbreviates a git commit hash for display.
+func shortHash(hash string) string {
+	if len(hash) > 12 {
+		return hash[:12]
 	}
+	return hash
+}
 
+// sameGitRemote returns true if two git remote URLs refer to the same
+// repository, ignoring trivial differences like a trailing ".git".
+func sameGitRemote(a, b string) bool {
+	normalize := func(url string) string {
+		url = strings.TrimSuffix(url, "/")
+		return strings.TrimSuffix(url, ".git")
+	}
+	return normalize(a) == normalize(b)
 }
 
 func doUpdate(cmd *cobra.Command, args []string) error {
+	// An empty --ref is meaningful (it removes the pin), so track whether
+	// the flag was specified at all.
+	flagUpdateRefSet = cmd.Flags().Changed("ref")
+
 	what := "libdragon\000toolchain"
 	if len(args) > 0 {
 		what = strings.Join(args, "\000")
@@ -109,7 +430,7 @@ func doUpdate(cmd *cobra.Command, args []string) error {
 	}
 
 	// Update the toolchain, if requested
-	if strings.Contains(what, "toolchain") {
+	if strings.Contains(what, "toolchain") && !flagUpdateDryRun {
 		color.Greenp("Updating toolchain...\n")
 		updateToolchain()
 	}
@@ -126,7 +447,13 @@ as argument a single item to update, which can be either "libdragon" or "docker"
 	Example: `  libdragon update
 	-- update libdragon and toolchain
   libdragon update toolchain
-      -- update toolchain only`,
+      -- update toolchain only
+  libdragon update libdragon --ref v1.0
+      -- pin libdragon to a specific tag
+  libdragon update libdragon --dry-run
+      -- show the changes that would be pulled into libdragon
+  libdragon update toolchain --refresh
+      -- update the toolchain to the latest version of the image`,
 	ValidArgs:    []string{"libdragon", "toolchain"},
 	Args:         cobra.OnlyValidArgs,
 	RunE:         doUpdate,
@@ -136,5 +463,12 @@ as argument a single item to update, which can be either "libdragon" or "docker"
 func init() {
 	cmdUpdate.Flags().StringVarP(&flagUpdateLibdragonPath, "directory", "d", "", "specify where libdragon is located (default: autodetect)")
 	cmdUpdate.Flags().StringVarP(&flagUpdateDockerImage, "image", "i", "", "specify the Docker image to use as a toolchain")
+	cmdUpdate.Flags().StringVarP(&flagUpdateRemote, "remote", "", "", "git URL of the libdragon repository to update from (saved for later updates)")
+	cmdUpdate.Flags().StringVarP(&flagUpdateBranch, "branch", "b", "", "libdragon branch to update from (saved for later updates)")
+	cmdUpdate.Flags().StringVarP(&flagUpdateRef, "ref", "r", "", "pin libdragon to a tag or commit (saved for later updates; use --ref= to unpin)")
+	cmdUpdate.Flags().BoolVarP(&flagUpdateRefresh, "refresh", "", false, "pull the latest version of the toolchain image, moving the pin in the lockfile")
+	cmdUpdate.Flags().BoolVarP(&flagUpdateYes, "yes", "y", false, "update libdragon without asking for confirmation")
+	cmdUpdate.Flags().BoolVarP(&flagUpdateDryRun, "dry-run", "n", false, "only show the changes in libdragon, without updating anything")
+	cmdUpdate.Flags().StringVarP(&flagUpdateArchive, "archive", "", "", "URL or path of the libdragon source archive to update from, for tarball vendoring (saved for later updates)")
 	rootCmd.AddCommand(cmdUpdate)
 }
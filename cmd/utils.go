@@ -1,12 +1,18 @@
 package cmd
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
+	"syscall"
 
 	"github.com/gookit/color"
 )
@@ -30,6 +36,22 @@ func critical(s string, args ...interface{}) {
 	fmt.Fprint(os.Stderr, text)
 }
 
+// confirm asks the user a yes/no question on the console, and returns true
+// if the answer is yes. The default answer is no. If the input is not a
+// terminal (eg: in CI), nobody can answer, so it aborts with fatal instead
+// of silently assuming the default: the commands asking for confirmation
+// have a --yes flag to skip the question.
+func confirm(s string, args ...interface{}) bool {
+	if !isTerminal(os.Stdin) {
+		fatal("error: cannot ask for confirmation, as the input is not a terminal (use --yes)\n")
+	}
+	text := color.Yellow.Render(fmt.Sprintf(s, args...))
+	fmt.Fprint(os.Stderr, text+" [y/N] ")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
+
 // fatal exits the process printing a formatted message to stderr
 func fatal(s string, args ...interface{}) {
 	critical(s, args...)
@@ -45,6 +67,17 @@ func fatal_exitproc(err error, command string, args []string) {
 	fatal("%v\n", err)
 }
 
+// exitCodeError is returned by commands that want the process to terminate with
+// a specific exit code (typically, the one of a command run in the toolchain),
+// without printing any further error message.
+type exitCodeError struct {
+	code int
+}
+
+func (e *exitCodeError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
 // getOutput runs the specified command with the specified arguments,
 // and acquires its output (stdout). The output is returned as a list
 // of strings, one per line.
@@ -79,14 +112,73 @@ func run(command string, args ...string) error {
 // stdout/stderr (attaching it to the parent console). If the command exits with
 // an error, the parent process is exited as well with the same error.
 func spawn(command string, args ...string) {
+	code, err := spawnExitCode(command, args...)
+	if err == nil && code != 0 {
+		err = &exitCodeError{code}
+	}
+	if err != nil {
+		fatal_exitproc(err, command, args)
+	}
+}
+
+// spawnExitCode is like spawn, but returns the exit code of the command instead
+// of aborting when it is not zero. An error is returned only if the command
+// could not be run at all.
+func spawnExitCode(command string, args ...string) (int, error) {
+	return spawnForwardSignals(nil, command, args...)
+}
+
+// spawnForwardSignals is like spawnExitCode, but while the command is running,
+// interrupt and termination requests (SIGINT / SIGTERM) received by this process
+// are passed to forward rather than terminating it. This is useful when the
+// command is a client for a process running elsewhere (eg: docker exec), that
+// would not be stopped just by killing the client. The function returns only
+// after forward has completed. If forward is nil, signals are not intercepted.
+func spawnForwardSignals(forward func(os.Signal), command string, args ...string) (int, error) {
+	return spawnRedirect(forward, os.Stdout, os.Stderr, command, args...)
+}
+
+// spawnRedirect is like spawnForwardSignals, but the output of the command is
+// written to the specified writers rather than to the console.
+func spawnRedirect(forward func(os.Signal), stdout io.Writer, stderr io.Writer, command string, args ...string) (int, error) {
 	cmd := exec.Command(command, args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 
 	if flagVerbose {
 		fmt.Println("launching:", command, args)
 	}
 
+	var forwarded chan os.Signal
+	done := make(chan struct{})
+	if forward != nil {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(sigs)
+
+		// Forward only the first signal: forward is in charge of escalating
+		// if the process does not stop.
+		forwarded = make(chan os.Signal, 1)
+		go func() {
+			var sig os.Signal
+			select {
+			case sig = <-sigs:
+				forward(sig)
+			case <-done:
+				// A signal might have been received together with the
+				// exit of the command, and select picks randomly among
+				// ready cases: drain it, so that it is not lost. There
+				// is no need to forward it, as the command is gone.
+				select {
+				case sig = <-sigs:
+				default:
+				}
+			}
+			forwarded <- sig
+		}()
+	}
+
 	err := cmd.Run()
 	if runtime.GOOS == "windows" {
 		if command == "git" {
@@ -95,10 +187,29 @@ func spawn(command string, args ...string) {
 		}
 	}
 
-	if err != nil {
-		fatal_exitproc(err, command, args)
+	// If a signal was received, wait for its forwarding to complete.
+	var sig os.Signal
+	if forward != nil {
+		close(done)
+		sig = <-forwarded
 	}
 
+	if ee, ok := err.(*exec.ExitError); ok {
+		code := ee.ExitCode()
+		if code < 0 && sig != nil {
+			// The command was killed by the signal itself: mimic the exit
+			// code that a shell would report.
+			code = 128 + 2
+			if sig == syscall.SIGTERM {
+				code = 128 + 15
+			}
+		}
+		return code, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
 }
 
 // mustOutput is like getOutput, but aborts the process with fatal if the
@@ -119,7 +230,21 @@ func mustRun(command string, args ...string) {
 	}
 }
 
-// isDir returns true if the specified path is a file
+// isTerminal returns true if the specified file is attached to a terminal
+// (console on Windows).
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	// The null device is a character device too, but not a terminal.
+	if null, err := os.Stat(os.DevNull); err == nil && os.SameFile(fi, null) {
+		return false
+	}
+	return true
+}
+
+// isFile returns true if the specified path is a file
 func isFile(path string) bool {
 	fi, err := os.Stat(path)
 	return err == nil && !fi.IsDir()
@@ -132,40 +257,67 @@ func isDir(path string) bool {
 }
 
 var (
-	cachedGitRoot     string
-	cachedGitRootOnce bool
+	cachedProjectRoot     string
+	cachedProjectRootOnce bool
+	cachedIsGitRepo       bool
 
-	cachedLibdragonPath          string
-	cachedLibdragonPathSubmodule bool
-	cachedLibdragonPathOnce      bool
+	cachedLibdragonPath     string
+	cachedLibdragonMode     string
+	cachedLibdragonPathOnce bool
 )
 
-// findGitRoot checks whether the current directory is part of a git repo; if so,
-// returns its root, otherwise returns "." which is a good default for all
-// situations in which we want to optionally find the root of a repo but we are
-// unable to.
-func findGitRootOrCwd() string {
-	if !cachedGitRootOnce {
-		cachedGitRootOnce = true
-		cachedGitRoot = "."
+// findProjectRoot returns the root of the project which contains the current
+// directory: the root of the git repository if there is one, otherwise the
+// nearest directory containing a project configuration or a libdragon tarball.
+// If none is found, returns "." which is a good default for all situations in
+// which we want to optionally find the root of a project but we are unable to.
+func findProjectRoot() string {
+	if !cachedProjectRootOnce {
+		cachedProjectRootOnce = true
+		cachedProjectRoot = "."
 
 		rootdir1, err := getOutput("git", "rev-parse", "--show-toplevel")
 		if err == nil {
-			cachedGitRoot, err = filepath.Abs(rootdir1[0])
+			cachedProjectRoot, err = filepath.Abs(rootdir1[0])
 			if err != nil {
 				fatal("error getting absolute path: %v", err)
 			}
+			cachedIsGitRepo = true
+			return cachedProjectRoot
+		}
+
+		dir, err := filepath.Abs(".")
+		if err != nil {
+			fatal("error getting absolute path: %v", err)
+		}
+		for {
+			if isFile(filepath.Join(dir, CONFIG_FILE)) || isFile(filepath.Join(dir, "libdragon", TARBALL_MANIFEST)) {
+				cachedProjectRoot = dir
+				break
+			}
+			parent := filepath.Dir(dir)
+			if parent == dir {
+				break
+			}
+			dir = parent
 		}
 	}
 
-	return cachedGitRoot
+	return cachedProjectRoot
+}
+
+// isGitRepo returns true if the project root (see findProjectRoot) is a git
+// repository.
+func isGitRepo() bool {
+	findProjectRoot()
+	return cachedIsGitRepo
 }
 
-// mustFindGitRoot is like findGitRoot, but aborts with fatal if no git repository
-// is found.
+// mustFindGitRoot is like findProjectRoot, but aborts with fatal if no git
+// repository is found.
 func mustFindGitRoot() string {
-	path := findGitRootOrCwd()
-	if path == "." {
+	path := findProjectRoot()
+	if !isGitRepo() {
 		if _, err := exec.LookPath("git"); err != nil {
 			critical("error: this command requires Git\n")
 			if runtime.GOOS == "windows" || true {
@@ -181,13 +333,47 @@ func mustFindGitRoot() string {
 
 // findLibdragon searches for the libdragon vendored directory in the git repo
 // which contains teh current directory. In case of success, it returns the path
-// of the directory within the repo, and a boolean indicating whether the
-// vendoring is being done via submodules (the alternative being subtrees).
-func findLibdragon() (string, bool) {
+// of the directory within the repo, and the vendoring mode (VENDOR_SUBTREE,
+// VENDOR_SUBMODULE or VENDOR_TARBALL).
+// The project configuration is looked up first; the result of the detection is
+// recorded in it the next time it is saved (see saveProjectConfig). Only the
+// tarball mode can be used outside of a git repository.
+func findLibdragon() (string, string) {
 	if !cachedLibdragonPathOnce {
 		cachedLibdragonPathOnce = true
 
-		repoRoot := mustFindGitRoot()
+		if cfg := config(); cfg.Libdragon.Path != "" {
+			cachedLibdragonPath = cfg.Libdragon.Path
+			cachedLibdragonMode = cfg.Libdragon.Mode
+			if cachedLibdragonMode == "" {
+				cachedLibdragonMode = VENDOR_SUBTREE
+			}
+			return cachedLibdragonPath, cachedLibdragonMode
+		}
+
+		repoRoot := findProjectRoot()
+
+		// Check if we're using a tarball, which can also be done outside
+		// of a git repository. It is vendored next to the Makefile, so
+		// look for it from the current directory up to the root.
+		if dir, err := filepath.Abs("."); err == nil && repoRoot != "." {
+			for {
+				if isFile(filepath.Join(dir, "libdragon", TARBALL_MANIFEST)) {
+					if reldir, err := filepath.Rel(repoRoot, dir); err == nil && !strings.HasPrefix(reldir, "..") {
+						cachedLibdragonPath = path.Join(filepath.ToSlash(reldir), "libdragon")
+						cachedLibdragonMode = VENDOR_TARBALL
+						return cachedLibdragonPath, cachedLibdragonMode
+					}
+				}
+				if dir == repoRoot || filepath.Dir(dir) == dir {
+					break
+				}
+				dir = filepath.Dir(dir)
+			}
+		}
+		if !isGitRepo() {
+			return "", ""
+		}
 
 		// Check if we're using submodules
 		if path, err := getOutput("git", "config",
@@ -195,44 +381,114 @@ func findLibdragon() (string, bool) {
 			"--get", "submodule."+LIBDRAGON_SUBMODULE+".path"); err == nil && path[0] != "" {
 
 			cachedLibdragonPath = path[0]
-			cachedLibdragonPathSubmodule = true
+			cachedLibdragonMode = VENDOR_SUBMODULE
 		} else {
-			// If we are using subtree, grep the logs to find the path
-			logs := mustOutput("git", "log", "--grep", "git-subtree-dir:", "--format=tformat:%b")
+			// If we are using subtree, grep the logs to find the path.
+			// This fails in a repository without commits, which has no
+			// subtree either.
+			logs, _ := getOutput("git", "log", "--grep", "git-subtree-dir:", "--format=tformat:%b")
 			for _, logline := range logs {
 				if strings.HasPrefix(logline, "git-subtree-dir:") && strings.HasSuffix(logline, "libdragon") {
 					fields := strings.SplitN(logline, ":", 2)
 
 					cachedLibdragonPath = strings.TrimSpace(fields[1])
-					cachedLibdragonPathSubmodule = false
+					cachedLibdragonMode = VENDOR_SUBTREE
 					break
 				}
 			}
 		}
 	}
 
-	return cachedLibdragonPath, cachedLibdragonPathSubmodule
+	return cachedLibdragonPath, cachedLibdragonMode
+}
+
+// setLibdragonVendoring records in the project configuration where and how
+// libdragon is vendored. The upstream remote and branch are recorded as well,
+// if they were not already.
+func setLibdragonVendoring(path string, mode string) {
+	cfg := projectConfigForUpdate()
+	if cfg.Libdragon.Remote == "" {
+		cfg.Libdragon.Remote = config().Libdragon.Remote
+	}
+	if cfg.Libdragon.Branch == "" {
+		cfg.Libdragon.Branch = config().Libdragon.Branch
+	}
+	cfg.Libdragon.Path = path
+	cfg.Libdragon.Mode = mode
+	saveProjectConfig()
+
+	cachedLibdragonPathOnce = true
+	cachedLibdragonPath = path
+	cachedLibdragonMode = mode
 }
 
+// Sources of the toolchain image, as reported by findDockerImageSource.
+var (
+	IMAGE_SOURCE_CONFIG      = CONFIG_FILE
+	IMAGE_SOURCE_USER_CONFIG = "user " + USER_CONFIG_FILE
+	IMAGE_SOURCE_LIBDRAGON   = "tools/.docker-toolchain"
+	IMAGE_SOURCE_DEFAULT     = "DOCKER_IMAGE"
+)
+
 // findDockerImage returns the docker image that should be used as toolchain.
 func findDockerImage() string {
-	// Check if there's a cached image file in the repository root. This is
-	// a local override requested by the user, so it wins over anything.
-	repoRoot := findGitRootOrCwd()
-	if imagebytes, err := os.ReadFile(filepath.Join(repoRoot, CACHED_IMAGE_FILE)); err == nil {
-		return strings.TrimSpace(string(imagebytes))
+	image, _ := findDockerImageSource()
+	return image
+}
+
+// findDockerImageSource is like findDockerImage, but also returns which source
+// the image was resolved from (one of the IMAGE_SOURCE_* constants).
+func findDockerImageSource() (string, string) {
+	// Check if an image is configured for the project. This is a local
+	// override requested by the user, so it wins over anything.
+	if image := projectConfigForUpdate().Toolchain.Image; image != "" {
+		return image, IMAGE_SOURCE_CONFIG
 	}
 
+	repoRoot := findProjectRoot()
+
 	// The specific libdragon version being used might contain a reference to the
 	// docker toolchain image to use. Use that if available.
 	libdragonPath, _ := findLibdragon()
 	if libdragonPath != "" {
 		// Check if there's a reference to the needed toolchain in libdragon
-		if imagebytes, err := os.ReadFile(filepath.Join(libdragonPath, "tools", ".docker-toolchain")); err == nil {
-			return strings.TrimSpace(string(imagebytes))
+		if imagebytes, err := os.ReadFile(filepath.Join(repoRoot, libdragonPath, "tools", ".docker-toolchain")); err == nil {
+			return strings.TrimSpace(string(imagebytes)), IMAGE_SOURCE_LIBDRAGON
 		}
 	}
 
-	// If anything else fails, fall back to the official image with a "latest" tag.
-	return DOCKER_IMAGE
+	// Otherwise, use the image configured by the user for all projects, and
+	// as a last resort, the official image with a "latest" tag.
+	if image := config().Toolchain.Image; image != "" {
+		return image, IMAGE_SOURCE_USER_CONFIG
+	}
+	return DOCKER_IMAGE, IMAGE_SOURCE_DEFAULT
+}
+
+// subtreeDirPattern returns an extended regular expression (for "git log -E
+// --grep") matching the "git-subtree-dir:" trailer of the subtree vendored at
+// the specified repo-relative path. The path is escaped, as it can contain
+// characters that are special in regular expressions (eg: "lib.c++").
+func subtreeDirPattern(prefix string) string {
+	return "^git-subtree-dir: " + regexp.QuoteMeta(prefix) + "$"
+}
+
+// findSubtreeSplit returns the upstream commit that was last merged into the
+// subtree vendored at the specified repo-relative path, by looking for the
+// "git-subtree-split:" trailer that "git subtree" leaves in its commits.
+// It returns an empty string if the commit cannot be found.
+func findSubtreeSplit(prefix string) string {
+	logs, err := getOutput("git", "log", "-1", "-E",
+		"--grep", subtreeDirPattern(prefix),
+		"--format=tformat:%b")
+	if err != nil {
+		return ""
+	}
+	for _, logline := range logs {
+		if strings.HasPrefix(logline, "git-subtree-split:") {
+			fields := strings.SplitN(logline, ":", 2)
+			return strings.TrimSpace(fields[1])
+		}
+	}
+	return ""
 }
@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagVendorConvertTo string
+)
+
+// mustBeClean aborts with fatal if the working tree of the repository has
+// uncommitted changes.
+func mustBeClean(repoRoot string) {
+	out := mustOutput("git", "-C", repoRoot, "status", "--porcelain")
+	if strings.TrimSpace(strings.Join(out, "")) != "" {
+		fatal("the working tree has uncommitted changes: commit or stash them first\n")
+	}
+}
+
+// updateLockVendored records in the lockfile (if any) the new hash of the
+// vendored libdragon copy, that changes when the vendoring mode is changed.
+// It returns true if the lockfile was updated.
+func updateLockVendored(vendored string) bool {
+	lock := readLockFile()
+	if lock.Libdragon == nil {
+		return false
+	}
+	lock.Libdragon.Vendored = vendored
+	writeLockFile(lock)
+	return true
+}
+
+// removeSubmodule removes the submodule at the specified repo-relative path.
+// The removal is staged. Its repository within .git is kept, so that nothing
+// is lost until the caller is done: its path is returned, for the caller to
+// remove it.
+func removeSubmodule(repoRoot, path string) string {
+	submodulePath := filepath.Join(repoRoot, path)
+	submoduleGitDir := mustOutput("git", "-C", submodulePath, "rev-parse", "--absolute-git-dir")[0]
+
+	spawn("git", "-C", repoRoot, "submodule", "deinit", "-q", "-f", "--", path)
+	spawn("git", "-C", repoRoot, "rm", "-q", "-f", "--", path)
+	os.RemoveAll(submodulePath) // leftover build artifacts
+	if out, _ := getOutput("git", "-C", repoRoot, "config", "--file", ".gitmodules", "--list"); out == nil || out[0] == "" {
+		run("git", "-C", repoRoot, "rm", "-q", "-f", "--", ".gitmodules")
+	}
+	return submoduleGitDir
+}
+
+// convertToSubmodule replaces the libdragon subtree at the specified
+// repo-relative path with a submodule, checked out at the same upstream
+// commit. The subtree must have no local commits: as commits within the
+// submodule, they would exist only in the local clone, so the submodule
+// commit recorded in the project could not be fetched by anyone else.
+func convertToSubmodule(repoRoot, path string) {
+	cfg := config()
+	split := findSubtreeSplit(path)
+	if split == "" {
+		fatal("cannot find the vendored libdragon commit\n")
+	}
+
+	if local := localVendoredCommits(path, false); len(local) > 0 {
+		critical("libdragon has %d local commits, which cannot be carried into a submodule:\n", len(local))
+		for _, c := range local {
+			fmt.Println("  " + c)
+		}
+		fatal("Send them upstream (see: libdragon contribute), or push them to a fork of libdragon\n" +
+			"and vendor it (libdragon update --remote <fork>), then convert again.\n")
+	}
+
+	progress("Replacing subtree %s with a submodule...\n", path)
+	spawn("git", "-C", repoRoot, "rm", "-r", "-q", "--", path)
+	os.RemoveAll(filepath.Join(repoRoot, path)) // leftover build artifacts
+	spawn("git", "-C", repoRoot, "submodule", "add", "--force",
+		"--name", LIBDRAGON_SUBMODULE,
+		"--branch", cfg.Libdragon.Branch,
+		"--", cfg.Libdragon.Remote, path)
+
+	submodulePath := filepath.Join(repoRoot, path)
+	if run("git", "-C", submodulePath, "checkout", "-q", "--detach", split) != nil {
+		// The commit might not be in the branch (eg: it was pinned with --ref)
+		spawn("git", "-C", submodulePath, "fetch", "origin", split)
+		spawn("git", "-C", submodulePath, "checkout", "-q", "--detach", split)
+	}
+
+	pcfg := projectConfigForUpdate()
+	pcfg.Libdragon.Path = path
+	pcfg.Libdragon.Mode = VENDOR_SUBMODULE
+	saveProjectConfig()
+	files := []string{".gitmodules", path, CONFIG_FILE}
+	if updateLockVendored(vendoredHash(path, VENDOR_SUBMODULE)) {
+		files = append(files, LOCK_FILE)
+	}
+
+	spawn("git", append([]string{"-C", repoRoot, "add", "--"}, files...)...)
+	spawn("git", "-C", repoRoot, "commit", "-q", "-m", "Convert libdragon from subtree to submodule")
+}
+
+// convertToSubtree replaces the libdragon submodule at the specified
+// repo-relative path with a subtree with the same content. Local commits
+// in the submodule become local changes to the subtree.
+func convertToSubtree(repoRoot, path string) {
+	submodulePath := filepath.Join(repoRoot, path)
+
+	// The upstream commit is the vendored one, recorded in the lockfile,
+	// on which the local commits (if any) are based. Without a lockfile,
+	// HEAD must be an upstream commit itself.
+	head := mustOutput("git", "-C", submodulePath, "rev-parse", "HEAD")[0]
+	upstream := lockedUpstreamCommit(submodulePath, path)
+	if upstream == "" {
+		if out, err := getOutput("git", "-C", submodulePath, "branch", "-r", "--contains", "HEAD"); err == nil && out[0] != "" {
+			upstream = head
+		}
+	}
+	if upstream == "" || run("git", "-C", submodulePath, "merge-base", "--is-ancestor", upstream, "HEAD") != nil {
+		fatal("cannot find the vendored libdragon commit (update libdragon first, with: libdragon update)\n")
+	}
+	if local := localVendoredCommits(path, true); len(local) > 0 {
+		progress("%d local commits to libdragon will become local changes to the subtree\n", len(local))
+	}
+
+	// Import the submodule history in the repository, and create the commit
+	// with the upstream content, in the same format used by "git subtree
+	// add --squash", so that it can be updated with "git subtree" later.
+	spawn("git", "-C", repoRoot, "fetch", "-q", "--no-tags", submodulePath, "HEAD")
+	squash := mustOutput("git", "-C", repoRoot, "commit-tree", upstream+"^{tree}", "-m",
+		fmt.Sprintf("Squashed '%s/' content from commit %s\n\ngit-subtree-dir: %s\ngit-subtree-split: %s",
+			path, shortHash(upstream), path, upstream))[0]
+
+	progress("Replacing submodule %s with a subtree...\n", path)
+	submoduleGitDir := removeSubmodule(repoRoot, path)
+	spawn("git", "-C", repoRoot, "read-tree", "--prefix="+path+"/", "-u", head+"^{tree}")
+
+	pcfg := projectConfigForUpdate()
+	pcfg.Libdragon.Path = path
+	pcfg.Libdragon.Mode = VENDOR_SUBTREE
+	saveProjectConfig()
+	files := []string{CONFIG_FILE}
+	if updateLockVendored(mustOutput("git", "-C", repoRoot, "rev-parse", head+"^{tree}")[0]) {
+		files = append(files, LOCK_FILE)
+	}
+	spawn("git", append([]string{"-C", repoRoot, "add", "--"}, files...)...)
+
+	// Commit as a merge of the squashed upstream content, like "git subtree"
+	// does, so that the subtree can be found and updated later.
+	tree := mustOutput("git", "-C", repoRoot, "write-tree")[0]
+	commit := mustOutput("git", "-C", repoRoot, "commit-tree", tree, "-p", "HEAD", "-p", squash,
+		"-m", "Convert libdragon from submodule to subtree")[0]
+	spawn("git", "-C", repoRoot, "update-ref", "-m", "libdragon vendor convert", "HEAD", commit)
+
+	// The submodule repository is not needed anymore, as its content is now
+	// committed in the project.
+	os.RemoveAll(submoduleGitDir)
+}
+
+func doVendorConvert(cmd *cobra.Command, args []string) error {
+	repoRoot := mustFindGitRoot()
+	mustBeClean(repoRoot)
+	path, submodule := mustFindGitLibdragon()
+	path = filepath.ToSlash(path)
+
+	switch flagVendorConvertTo {
+	case VENDOR_SUBMODULE:
+		if submodule {
+			fatal("libdragon is already vendored as a submodule\n")
+		}
+		convertToSubmodule(repoRoot, path)
+	case VENDOR_SUBTREE:
+		if !submodule {
+			fatal("libdragon is already vendored as a subtree\n")
+		}
+		convertToSubtree(repoRoot, path)
+	default:
+		fatal("invalid vendoring mode: %q (must be %s or %s)\n", flagVendorConvertTo, VENDOR_SUBMODULE, VENDOR_SUBTREE)
+	}
+
+	progress("Converted libdragon to %s. Review the changes with: git show\n", flagVendorConvertTo)
+	return nil
+}
+
+var cmdVendor = &cobra.Command{
+	Use:   "vendor",
+	Short: "Manage how libdragon is vendored in the current repository.",
+}
+
+var cmdVendorConvert = &cobra.Command{
+	Use:   "convert",
+	Short: "Convert the vendored libdragon copy between subtree and submodule.",
+	Long: `This command switches the vendoring of libdragon between git subtree and git
+submodule, keeping the same upstream libdragon commit. Local commits to the
+submodule are carried across as changes to the subtree. A subtree with local
+commits cannot be converted, as they would exist only in the local submodule:
+send them upstream or to a fork of libdragon first.
+
+The conversion is recorded as a single commit, that can be reviewed (and reverted
+if required). The working tree must be clean.`,
+	Example: `  libdragon vendor convert --to submodule
+	-- switch from subtree to submodule`,
+	Args:         cobra.NoArgs,
+	RunE:         doVendorConvert,
+	SilenceUsage: true,
+}
+
+func init() {
+	cmdVendorConvert.Flags().StringVarP(&flagVendorConvertTo, "to", "", "", "vendoring mode to convert to ("+VENDOR_SUBMODULE+" or "+VENDOR_SUBTREE+")")
+	cmdVendorConvert.MarkFlagRequired("to")
+	cmdVendor.AddCommand(cmdVendorConvert)
+	rootCmd.AddCommand(cmdVendor)
+}
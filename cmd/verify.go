@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+)
+
+// verifyLibdragon checks the vendored libdragon copy against the lockfile. It
+// returns false (after reporting the problem) if they differ.
+func verifyLibdragon(lock *vendorLock) bool {
+	path, mode := findLibdragon()
+	if path == "" {
+		critical("libdragon: cannot find libdragon in this repository\n")
+		return false
+	}
+	return verifyVendored("libdragon", path, mode, lock)
+}
+
+// verifyDep checks a vendored dependency against the lockfile. It returns
+// false (after reporting the problem) if they differ.
+func verifyDep(name string, lock *vendorLock) bool {
+	dep, found := config().Deps[name]
+	if !found {
+		critical("%s: dependency is in the lockfile, but not in %s\n", name, CONFIG_FILE)
+		return false
+	}
+	return verifyVendored(name, dep.Path, dep.Mode, lock)
+}
+
+// verifyVendored checks the library vendored at the specified path with the
+// specified mode against the lockfile.
+func verifyVendored(name, path, mode string, lock *vendorLock) bool {
+	if vendored := vendoredHash(path, mode); vendored != lock.Vendored {
+		critical("%s: vendored copy in %s differs from the lockfile\n", name, path)
+		critical("  locked:   %s (upstream commit %s)\n", lock.Vendored, lock.Commit)
+		critical("  vendored: %s\n", vendored)
+		return false
+	}
+	// For tarballs, the hash already covers the files on disk.
+	if mode != VENDOR_TARBALL {
+		if out, err := getOutput("git", "-C", findProjectRoot(), "status", "--porcelain", "--", filepath.ToSlash(path)); err != nil || out[0] != "" {
+			critical("%s: vendored copy in %s has uncommitted changes\n", name, path)
+			return false
+		}
+	}
+	progress("%s: OK (upstream commit %s)\n", name, lock.Commit)
+	return true
+}
+
+// verifyToolchain checks the toolchain image against the lockfile. It returns
+// false (after reporting the problem) if they differ.
+func verifyToolchain(lock *toolchainLock) bool {
+	if findToolchain().Name() == TOOLCHAIN_NATIVE {
+		progress("toolchain: native toolchain in use, skipping image check\n")
+		return true
+	}
+	image := findDockerImage()
+	if image != lock.Image {
+		critical("toolchain: image %s differs from the locked image %s\n", image, lock.Image)
+		return false
+	}
+	// Containers are created from the pinned image (whatever the tag of the
+	// image points to now), so it is enough to check that it was pulled:
+	// its content is guaranteed by the digest.
+	if _, err := mustFindRuntime().ImageDigest(lock.Digest); err != nil {
+		critical("toolchain: pinned image %s is not available (run: libdragon update toolchain)\n", lock.Digest)
+		return false
+	}
+	progress("toolchain: OK (%s)\n", lock.Digest)
+	return true
+}
+
+func doVerify(cmd *cobra.Command, args []string) error {
+	lock := readLockFile()
+	if lock.Libdragon == nil && lock.Toolchain == nil && len(lock.Deps) == 0 {
+		fatal("no lockfile found (run: libdragon update)\n")
+	}
+
+	ok := true
+	if lock.Libdragon != nil && !verifyLibdragon(lock.Libdragon) {
+		ok = false
+	}
+	for _, name := range sortedDepNames(lock.Deps) {
+		if !verifyDep(name, lock.Deps[name]) {
+			ok = false
+		}
+	}
+	if lock.Toolchain != nil && !verifyToolchain(lock.Toolchain) {
+		ok = false
+	}
+	if !ok {
+		return &exitCodeError{1}
+	}
+	return nil
+}
+
+var cmdVerify = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify that vendored libdragon and the toolchain match the lockfile.",
+	Long: `This command checks that the vendored libdragon copy is exactly the one recorded
+in the lockfile (libdragon.lock) by the last update, and that the toolchain
+image pinned there is available. It exits with an error otherwise, so it can
+be used in CI.`,
+	Example: `  libdragon verify
+	-- check that libdragon and the toolchain match the lockfile`,
+	Args:         cobra.NoArgs,
+	RunE:         doVerify,
+	SilenceUsage: true,
+}
+
+func init() {
+	rootCmd.AddCommand(cmdVerify)
+}
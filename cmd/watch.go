@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gookit/color"
+	"github.com/spf13/cobra"
+)
+
+var (
+	flagWatchDebounce time.Duration
+	flagWatchExec     string
+)
+
+// watchPollInterval is how often the files are checked for changes.
+const watchPollInterval = 250 * time.Millisecond
+
+// watchRefreshInterval is how often the list of watched files is refreshed
+// anyway, in case it changed in ways that watchList does not detect.
+const watchRefreshInterval = 10 * time.Second
+
+// watchOutputExts are the extensions of build outputs, which are never watched,
+// even if they are not ignored by git.
+var watchOutputExts = map[string]bool{
+	".o": true, ".d": true, ".a": true, ".elf": true, ".z64": true, ".v64": true, ".n64": true,
+	".dfs": true, ".sym": true, ".map": true,
+}
+
+// fileState is the state of a watched file, used to detect changes.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// isWatched returns true if changes to the specified file (relative to the
+// root) should trigger a build. Build directories and outputs are skipped.
+func isWatched(name string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == "build" || part == ".git" {
+			return false
+		}
+	}
+	return !watchOutputExts[filepath.Ext(name)] && filepath.Base(name) != "compile_commands.json"
+}
+
+// watchedFiles returns the list of files to watch, relative to the root. In a
+// git repository, they are the files that git tracks or would track (so that
+// the files ignored by .gitignore are skipped); otherwise, all the files in
+// the root, except for hidden directories.
+func watchedFiles(root string) []string {
+	var files []string
+	if isGitRepo() {
+		out := mustOutput("git", "-C", root, "ls-files", "-z", "--cached", "--others", "--exclude-standard")
+		for _, name := range strings.Split(strings.Join(out, "\n"), "\x00") {
+			if name != "" && isWatched(name) {
+				files = append(files, filepath.FromSlash(name))
+			}
+		}
+		return files
+	}
+
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return nil
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if strings.HasPrefix(info.Name(), ".") || !isWatched(name) {
+				return filepath.SkipDir
+			}
+		} else if isWatched(name) {
+			files = append(files, name)
+		}
+		return nil
+	})
+	return files
+}
+
+// statFile returns the state of a file, with a size of -1 if it is missing.
+func statFile(path string) fileState {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileState{size: -1}
+	}
+	return fileState{fi.Size(), fi.ModTime()}
+}
+
+// watchList is the list of watched files (see watchedFiles). It is cached, as
+// listing the files can be slow in large repositories, and refreshed only
+// when the files it depends on change: the git index, the ignore files, and
+// the directories of the watched files (which change when files are added or
+// removed).
+type watchList struct {
+	root    string
+	files   []string
+	deps    map[string]fileState
+	updated time.Time
+}
+
+// Files returns the list of watched files, refreshing it if needed.
+func (wl *watchList) Files() []string {
+	if wl.deps == nil || time.Since(wl.updated) >= watchRefreshInterval {
+		wl.refresh()
+	} else {
+		for path, st := range wl.deps {
+			if statFile(path) != st {
+				vprintf("refreshing the watched files (%s changed)\n", path)
+				wl.refresh()
+				break
+			}
+		}
+	}
+	return wl.files
+}
+
+func (wl *watchList) refresh() {
+	wl.updated = time.Now()
+	wl.files = watchedFiles(wl.root)
+	wl.deps = make(map[string]fileState)
+	dep := func(path string) {
+		if _, found := wl.deps[path]; !found {
+			wl.deps[path] = statFile(path)
+		}
+	}
+
+	dep(wl.root)
+	for _, name := range wl.files {
+		for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+			dep(filepath.Join(wl.root, dir))
+		}
+		if filepath.Base(name) == ".gitignore" {
+			dep(filepath.Join(wl.root, name))
+		}
+	}
+	if isGitRepo() {
+		for _, name := range []string{"index", "info/exclude"} {
+			if out, err := getOutput("git", "-C", wl.root, "rev-parse", "--git-path", name); err == nil {
+				path := out[0]
+				if !filepath.IsAbs(path) {
+					path = filepath.Join(wl.root, path)
+				}
+				dep(path)
+			}
+		}
+	}
+}
+
+// watchSnapshot returns the state of the watched files.
+func watchSnapshot(wl *watchList) map[string]fileState {
+	snap := make(map[string]fileState)
+	for _, name := range wl.Files() {
+		// Deleted files are still listed by git, until the deletion is
+		// staged: record them as missing.
+		path := filepath.Join(wl.root, name)
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			continue
+		}
+		snap[name] = statFile(path)
+	}
+	return snap
+}
+
+// snapshotChanges returns the files that changed between two snapshots.
+func snapshotChanges(old, cur map[string]fileState) []string {
+	var changed []string
+	for name, st := range cur {
+		if ost, found := old[name]; !found || ost != st {
+			changed = append(changed, name)
+		}
+	}
+	for name := range old {
+		if _, found := cur[name]; !found {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// runHostCommand runs a command line on the host, through the shell.
+func runHostCommand(cmdline string) (int, error) {
+	if runtime.GOOS == "windows" {
+		return spawnExitCode("cmd", "/C", cmdline)
+	}
+	return spawnExitCode("sh", "-c", cmdline)
+}
+
+// watchBuild runs a build, and prints a summary of the result. It returns an
+// error only if the build was interrupted by the user.
+func watchBuild(args []string) error {
+	start := time.Now()
+	err := runMake(args)
+	elapsed := time.Since(start).Round(100 * time.Millisecond)
+	stamp := time.Now().Format("15:04:05")
+
+	var ee *exitCodeError
+	if errors.As(err, &ee) && (ee.code == 128+2 || ee.code == 128+15) {
+		return err
+	}
+	if err != nil {
+		critical("[%s] Build FAILED (%v) in %v\n", stamp, err, elapsed)
+		return nil
+	}
+	progress("[%s] Build OK in %v\n", stamp, elapsed)
+
+	if flagWatchExec != "" {
+		code, err := runHostCommand(flagWatchExec)
+		if err != nil || code != 0 {
+			critical("[%s] command failed: %s (exit code %d)\n", stamp, flagWatchExec, code)
+		}
+	}
+	return nil
+}
+
+func doWatch(cmd *cobra.Command, args []string) error {
+	wl := &watchList{root: findProjectRoot()}
+
+	// Start from a build, so that the project is up to date with the
+	// changes made before starting to watch. The files it generates are
+	// part of the initial state.
+	if err := watchBuild(args); err != nil {
+		return err
+	}
+	snap := watchSnapshot(wl)
+
+	fmt.Println(color.Gray.Render(fmt.Sprintf("Watching %d files for changes (press Ctrl+C to stop)...", len(snap))))
+	var lastChange time.Time
+	pending := false
+	for {
+		time.Sleep(watchPollInterval)
+
+		// Changes made while a build is running are detected when it
+		// completes, so that they trigger a single further build.
+		cur := watchSnapshot(wl)
+		if changed := snapshotChanges(snap, cur); len(changed) > 0 {
+			vprintf("changed: %v\n", changed)
+			snap = cur
+			lastChange = time.Now()
+			pending = true
+			continue
+		}
+
+		// Wait for a burst of changes to settle before building.
+		if pending && time.Since(lastChange) >= flagWatchDebounce {
+			pending = false
+			if err := watchBuild(args); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+var cmdWatch = &cobra.Command{
+	Use:   "watch [make args...]",
+	Short: "Rebuild the project whenever its files change.",
+	Long: `This command watches the files in the repository, and rebuilds the project
+with "libdragon make" whenever they change. Build outputs (the build directories,
+ROMs, ELF files, etc.), the .git directory and the files ignored by git are not
+watched.
+
+Changes are collected until no further changes happen for a short time
+(--debounce), so that a single build is run for a burst of changes. Changes
+done while a build is running trigger one further build when it completes.
+
+After each successful build, a command can be run on the host with --exec
+(eg: to reload the ROM in an emulator).`,
+	Example: `  libdragon watch
+	-- rebuild the project whenever it changes
+  libdragon watch --exec "./reload.sh build/game.z64" game.z64
+	-- build the game.z64 target, and run a script after each successful build`,
+	RunE:         doWatch,
+	SilenceUsage: true,
+}
+
+func init() {
+	cmdWatch.Flags().SetInterspersed(false)
+	cmdWatch.Flags().DurationVarP(&flagWatchDebounce, "debounce", "", 300*time.Millisecond, "time to wait after a change before building, to collect further changes")
+	cmdWatch.Flags().StringVarP(&flagWatchExec, "exec", "x", "", "command to run on the host after each successful build")
+	rootCmd.AddCommand(cmdWatch)
+}
@@ -3,7 +3,9 @@ module github.com/rasky/libdragon-cli
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/gookit/color v1.4.2
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/pflag v1.0.5 // indirect
 	golang.org/x/sys v0.0.0-20210330210617-4fbd30eecc44